@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+func isAccountingEmailConfigured() bool {
+	return config.SmtpAddress != "" && config.SmtpFrom != "" && config.AccountingEmail != ""
+}
+
+// sendMonthToAccounting e-mails the ZIP of a billing month to the accounting
+// office and marks the month as acknowledged once the server accepted it. The
+// same package (the same invoices) is sent only once.
+func sendMonthToAccounting(year int, month int, invoices []Invoice, actor string) (*GeneratedZip, error) {
+	zipPath, generated, err := generateMonthZip(year, month, invoices, actor)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(zipPath)
+	msg, err := buildAccountingEmail(fmt.Sprintf("%04d-%02d", year, month), len(invoices), generated.FileName, zipPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := claimAccountingSend(generated); err != nil {
+		return nil, err
+	}
+	if err := sendAccountingEmail(msg); err != nil {
+		if resetErr := db.Model(generated).Updates(map[string]any{"sent_to_accounting_at": nil, "sent_to": ""}).Error; resetErr != nil {
+			log.Printf("error resetting the accounting send of %v: %v", generated.FileName, resetErr)
+		}
+		return nil, fmt.Errorf("error sending e-mail: %v", err)
+	}
+	recordAuditEvent(actor, AuditZipSentToAccounting, 0, fmt.Sprintf("%v to %v", generated.FileName, config.AccountingEmail))
+	if err := acknowledgeMonth(year, month, actor); err != nil {
+		return nil, fmt.Errorf("e-mail sent, but marking the month as sent failed: %v", err)
+	}
+	return generated, nil
+}
+
+// claimAccountingSend records that the ZIP is being sent to accounting, it fails if it
+// was sent already, e.g. when the confirmation button is pressed twice
+func claimAccountingSend(generated *GeneratedZip) error {
+	now := time.Now()
+	result := db.Model(&GeneratedZip{}).
+		Where("id = ? AND sent_to_accounting_at IS NULL", generated.ID).
+		Updates(GeneratedZip{SentToAccountingAt: &now, SentTo: config.AccountingEmail})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := db.First(generated, generated.ID).Error; err != nil {
+			return err
+		}
+		sentAt := ""
+		if generated.SentToAccountingAt != nil {
+			sentAt = " on " + generated.SentToAccountingAt.Format("2006-01-02 15:04")
+		}
+		return fmt.Errorf("%v was already sent to %v%v", generated.FileName, generated.SentTo, sentAt)
+	}
+	generated.SentToAccountingAt = &now
+	generated.SentTo = config.AccountingEmail
+	return nil
+}
+
+// buildAccountingEmail composes the e-mail carrying the monthly ZIP to the accounting office
+func buildAccountingEmail(month string, invoiceCount int, zipName string, zipPath string) ([]byte, error) {
+	from, err := mail.ParseAddress(config.SmtpFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp_from address: %v", err)
+	}
+	to, err := mail.ParseAddressList(config.AccountingEmail)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accounting_email address: %v", err)
+	}
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{from})
+	h.SetAddressList("To", to)
+	h.SetSubject("Faktury GK " + month)
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	mw, err := mail.CreateWriter(buf, h)
+	if err != nil {
+		return nil, err
+	}
+	var th mail.InlineHeader
+	th.Set("Content-Type", "text/plain; charset=utf-8")
+	tw, err := mw.CreateSingleInline(th)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(tw, "Dzień dobry,\r\n\r\nw załączniku przesyłamy faktury za %v (liczba faktur: %v).\r\n", month, invoiceCount)
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	var ah mail.AttachmentHeader
+	ah.Set("Content-Type", "application/zip")
+	ah.SetFilename(zipName)
+	aw, err := mw.CreateAttachment(ah)
+	if err != nil {
+		return nil, err
+	}
+	zipFile, err := os.Open(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Close()
+	if _, err := io.Copy(aw, zipFile); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendAccountingEmail delivers msg to the configured accounting address.
+// Port 465 uses implicit TLS, anything else STARTTLS when the server offers it.
+func sendAccountingEmail(msg []byte) error {
+	host, port, err := net.SplitHostPort(config.SmtpAddress)
+	if err != nil {
+		return fmt.Errorf("invalid smtp_address: %v", err)
+	}
+	from, err := mail.ParseAddress(config.SmtpFrom)
+	if err != nil {
+		return fmt.Errorf("invalid smtp_from address: %v", err)
+	}
+	to, err := mail.ParseAddressList(config.AccountingEmail)
+	if err != nil {
+		return fmt.Errorf("invalid accounting_email address: %v", err)
+	}
+	var auth smtp.Auth
+	if config.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", config.SmtpUsername, config.SmtpPassword, host)
+	}
+	recipients := []string{}
+	for _, addr := range to {
+		recipients = append(recipients, addr.Address)
+	}
+	if port != "465" {
+		return smtp.SendMail(config.SmtpAddress, auth, from.Address, recipients, msg)
+	}
+
+	conn, err := tls.Dial("tcp", config.SmtpAddress, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+type receivedEmail struct {
+	From string
+	To   []string
+	// the AUTH PLAIN credentials, without the authorization identity
+	Auth string
+	Data []byte
+}
+
+// testSmtpServer is a localhost stand-in which accepts every e-mail
+type testSmtpServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	received []receivedEmail
+}
+
+func startTestSmtpServer(t *testing.T) *testSmtpServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSmtpServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *testSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ESMTP")
+	email := receivedEmail{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			credentials, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			email.Auth = strings.TrimPrefix(string(credentials), "\x00")
+			reply("235 Authenticated")
+		case "MAIL":
+			email.From = strings.Trim(strings.TrimPrefix(line[len("MAIL "):], "FROM:"), "<>")
+			reply("250 OK")
+		case "RCPT":
+			email.To = append(email.To, strings.Trim(strings.TrimPrefix(line[len("RCPT "):], "TO:"), "<>"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			data := &bytes.Buffer{}
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			email.Data = data.Bytes()
+			s.mu.Lock()
+			s.received = append(s.received, email)
+			s.mu.Unlock()
+			email = receivedEmail{}
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *testSmtpServer) Received() []receivedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedEmail{}, s.received...)
+}
+
+func TestSendzipEmailsAccountingOnce(t *testing.T) {
+	recorder := setupTestBot(t)
+	smtpServer := startTestSmtpServer(t)
+	config.SmtpAddress = smtpServer.listener.Addr().String()
+	config.SmtpUsername = "bot"
+	config.SmtpPassword = "secret"
+	config.SmtpFrom = "GK Invoices <invoices@example.com>"
+	config.AccountingEmail = "accounting@example.com"
+	pressButton("/notifications yes")
+	uploadDocument(recorder, "faktura.pdf", readTestdata(t, "invoice_simple.pdf"))
+
+	sendCommand("/sendzip 2023-03")
+	if msg := lastMessage(t, recorder, testChatID); !hasButton(msg, "/sendzip 2023-03 confirm") {
+		t.Fatalf("expected a confirmation button, got %q %+v", msg.Text, msg.Buttons)
+	}
+	pressButton("/sendzip 2023-03 confirm")
+	received := smtpServer.Received()
+	if len(received) != 1 {
+		t.Fatalf("expected one e-mail, got %v", len(received))
+	}
+	email := received[0]
+	if email.From != "invoices@example.com" || strings.Join(email.To, ",") != "accounting@example.com" || email.Auth != "bot\x00secret" {
+		t.Fatalf("unexpected envelope: %+v", email)
+	}
+	reader, err := mail.CreateReader(bytes.NewReader(email.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, _ := reader.Header.Subject(); subject != "Faktury GK 2023-03" {
+		t.Fatalf("unexpected subject: %q", subject)
+	}
+	attachments := []string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if h, ok := part.Header.(*mail.AttachmentHeader); ok {
+			name, _ := h.Filename()
+			attachments = append(attachments, name)
+		}
+	}
+	if strings.Join(attachments, ",") != "GK_faktury_2023-03.zip" {
+		t.Fatalf("unexpected attachments: %v", attachments)
+	}
+	chat := &NotifiedChat{}
+	if err := db.First(chat).Error; err != nil {
+		t.Fatal(err)
+	}
+	if chat.LastAcknowledgedYear != 2023 || chat.LastAcknowledgedMonth != 3 {
+		t.Fatalf("month not acknowledged: %+v", chat)
+	}
+	generated := &GeneratedZip{}
+	if err := db.First(generated).Error; err != nil {
+		t.Fatal(err)
+	}
+	if generated.SentToAccountingAt == nil || generated.SentTo != "accounting@example.com" {
+		t.Fatalf("the send wasn't recorded: %+v", generated)
+	}
+
+	// pressing the button again doesn't send the same package twice
+	pressButton("/sendzip 2023-03 confirm")
+	if len(smtpServer.Received()) != 1 {
+		t.Fatalf("the package was sent again")
+	}
+	if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, "was already sent to accounting@example.com") {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+}
+
+func TestSendzipFailureCanBeRetried(t *testing.T) {
+	recorder := setupTestBot(t)
+	// nothing listens on the address, so the e-mail can't be sent
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SmtpAddress = listener.Addr().String()
+	listener.Close()
+	config.SmtpFrom = "invoices@example.com"
+	config.AccountingEmail = "accounting@example.com"
+	uploadDocument(recorder, "faktura.pdf", readTestdata(t, "invoice_simple.pdf"))
+
+	pressButton("/sendzip 2023-03 confirm")
+	if msg := lastMessage(t, recorder, testChatID); !strings.HasPrefix(msg.Text, "Error: error sending e-mail") {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+	generated := &GeneratedZip{}
+	if err := db.First(generated).Error; err != nil {
+		t.Fatal(err)
+	}
+	if generated.SentToAccountingAt != nil {
+		t.Fatalf("a failed send was recorded: %+v", generated)
+	}
+
+	smtpServer := startTestSmtpServer(t)
+	config.SmtpAddress = smtpServer.listener.Addr().String()
+	pressButton("/sendzip 2023-03 confirm")
+	if len(smtpServer.Received()) != 1 {
+		t.Fatalf("expected the retry to send the e-mail")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum size of an invoice uploaded through the API
+const apiMaxUploadSize = 32 << 20
+
+type apiInvoice struct {
+	ID            uint   `json:"id"`
+	FileName      string `json:"file_name"`
+	UploadedAt    string `json:"uploaded_at"`
+	BillingMonth  string `json:"billing_month"`
+	Sha256        string `json:"sha256"`
+	InvoiceNumber string `json:"invoice_number,omitempty"`
+	SellerNIP     string `json:"seller_nip,omitempty"`
+	IssueDate     string `json:"issue_date,omitempty"`
+	NetAmount     string `json:"net_amount,omitempty"`
+	VatAmount     string `json:"vat_amount,omitempty"`
+	GrossAmount   string `json:"gross_amount,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	Source        string `json:"source,omitempty"`
+	Sender        string `json:"sender,omitempty"`
+	Subject       string `json:"subject,omitempty"`
+	DuplicateOf   *uint  `json:"duplicate_of,omitempty"`
+	Warning       string `json:"warning,omitempty"`
+}
+
+func newApiInvoice(invoice Invoice) apiInvoice {
+	optionalAmount := func(v *int64) string {
+		if v == nil {
+			return ""
+		}
+		return formatAmount(*v, "")
+	}
+	result := apiInvoice{
+		ID:            invoice.ID,
+		FileName:      invoice.FileName,
+		UploadedAt:    invoice.CreatedAt.Format(time.RFC3339),
+		BillingMonth:  invoice.BillingPeriod(),
+		Sha256:        invoice.Sha256,
+		InvoiceNumber: invoice.InvoiceNumber,
+		SellerNIP:     invoice.SellerNIP,
+		NetAmount:     optionalAmount(invoice.NetAmount),
+		VatAmount:     optionalAmount(invoice.VatAmount),
+		GrossAmount:   optionalAmount(invoice.GrossAmount),
+		Currency:      invoice.Currency,
+	}
+	if invoice.IssueDate != nil {
+		result.IssueDate = invoice.IssueDate.Format("2006-01-02")
+	}
+	result.DuplicateOf = invoice.DuplicateOfID
+	if invoice.Source != nil {
+		result.Source = invoice.Source.Channel
+		result.Sender = invoice.Source.Sender
+		result.Subject = invoice.Source.Subject
+	}
+	return result
+}
+
+func hashApiToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// createApiToken generates a new token, the plain token is only ever returned here
+func createApiToken(name string, createdBy int64) (string, *ApiToken, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(buf)
+	apiToken := &ApiToken{
+		Name:      name,
+		TokenHash: hashApiToken(token),
+		CreatedBy: createdBy,
+	}
+	if err := db.Create(&apiToken).Error; err != nil {
+		return "", nil, err
+	}
+	return token, apiToken, nil
+}
+
+func registerApiHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/months", requireApiToken(handleApiMonths))
+	mux.HandleFunc("/api/months/", requireApiToken(handleApiMonth))
+	mux.HandleFunc("/api/invoices", requireApiToken(handleApiUpload))
+	mux.HandleFunc("/api/invoices/", requireApiToken(handleApiInvoice))
+}
+
+func requireApiToken(handler func(w http.ResponseWriter, r *http.Request, token *ApiToken)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		apiToken := &ApiToken{}
+		if !strings.HasPrefix(header, "Bearer ") || token == "" || db.Where("token_hash = ?", hashApiToken(token)).First(&apiToken).Error != nil {
+			writeApiError(w, http.StatusUnauthorized, errors.New("invalid or missing API token"))
+			return
+		}
+		now := time.Now()
+		db.Model(&apiToken).Update("last_used_at", &now)
+		handler(w, r, apiToken)
+	}
+}
+
+func writeApiJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing API response: %v", err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, err error) {
+	writeApiJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// GET /api/months
+func handleApiMonths(w http.ResponseWriter, r *http.Request, token *ApiToken) {
+	if r.Method != http.MethodGet {
+		writeApiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	rows, err := db.Raw("SELECT printf('%04d-%02d', billing_year, billing_month) as month, COUNT(*) as count FROM invoices WHERE deleted_at IS NULL GROUP BY month ORDER BY month DESC").Rows()
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	type apiMonth struct {
+		Month string `json:"month"`
+		Count int    `json:"count"`
+	}
+	months := []apiMonth{}
+	for rows.Next() {
+		m := apiMonth{}
+		if err := rows.Scan(&m.Month, &m.Count); err != nil {
+			writeApiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		months = append(months, m)
+	}
+	writeApiJSON(w, http.StatusOK, months)
+}
+
+// GET /api/months/YYYY-MM/invoices, GET /api/months/YYYY-MM/zip, POST /api/months/YYYY-MM/acknowledge
+func handleApiMonth(w http.ResponseWriter, r *http.Request, token *ApiToken) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/months/"), "/")
+	if len(parts) != 2 {
+		writeApiError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	year, month, err := parseYearMonth(parts[0])
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case parts[1] == "invoices" && r.Method == http.MethodGet:
+		invoices, err := findMonthInvoices(year, month)
+		if err != nil {
+			writeApiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		result := []apiInvoice{}
+		for _, invoice := range invoices {
+			result = append(result, newApiInvoice(invoice))
+		}
+		writeApiJSON(w, http.StatusOK, result)
+	case parts[1] == "zip" && r.Method == http.MethodGet:
+		invoices, err := findMonthInvoices(year, month)
+		if err != nil {
+			writeApiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		serveMonthZip(w, year, month, invoices, "api "+token.Name)
+	case parts[1] == "acknowledge" && r.Method == http.MethodPost:
+		if err := acknowledgeMonth(year, month, "api "+token.Name); err != nil {
+			writeApiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		notifyAllChats(fmt.Sprintf("API client <b>%v</b> marked month %v as sent.", html.EscapeString(token.Name), parts[0]))
+		writeApiJSON(w, http.StatusOK, map[string]string{"acknowledged": parts[0]})
+	default:
+		writeApiError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// POST /api/invoices with the file in the "file" field of a multipart form
+func handleApiUpload(w http.ResponseWriter, r *http.Request, token *ApiToken) {
+	if r.Method != http.MethodPost {
+		writeApiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxUploadSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, fmt.Errorf("error reading the file field: %v", err))
+		return
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err)
+		return
+	}
+	invoice, err := processIncomingInvoice(header.Filename, contents, newApiInvoiceSource(token))
+	if errors.Is(err, ErrInvoiceExists) {
+		writeApiError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := newApiInvoice(*invoice)
+	result.Warning = lateInvoiceWarning(invoice)
+	notifyAllChats(fmt.Sprintf("API client <b>%v</b> uploaded invoice <b>%v</b> for %v.",
+		html.EscapeString(token.Name), html.EscapeString(invoice.FileName), invoice.BillingPeriod()))
+	askAboutDuplicate(0, 0, invoice)
+	writeApiJSON(w, http.StatusCreated, result)
+}
+
+// GET /api/invoices/ID downloads a single invoice
+func handleApiInvoice(w http.ResponseWriter, r *http.Request, token *ApiToken) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/invoices/"))
+	if err != nil || r.Method != http.MethodGet {
+		writeApiError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	invoice := &Invoice{}
+	if err := db.First(&invoice, id).Error; err != nil {
+		writeApiError(w, http.StatusNotFound, errors.New("invoice not found"))
+		return
+	}
+	serveInvoiceFile(w, invoice, "api "+token.Name)
+}
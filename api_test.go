@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// apiRequest sends a request to a fresh web mux and returns the recorded response
+func apiRequest(t *testing.T, method, path, authorization string, body *bytes.Buffer, contentType string) *httptest.ResponseRecorder {
+	t.Helper()
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	req := httptest.NewRequest(method, path, body)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	newWebMux().ServeHTTP(rec, req)
+	return rec
+}
+
+func createTestApiToken(t *testing.T) string {
+	t.Helper()
+	token, _, err := createApiToken("accounting", testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func uploadApiInvoice(t *testing.T, token, name string, contents []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(contents)
+	form.Close()
+	return apiRequest(t, http.MethodPost, "/api/invoices", "Bearer "+token, body, form.FormDataContentType())
+}
+
+func TestApiRequiresBearerToken(t *testing.T) {
+	setupTestBot(t)
+	token := createTestApiToken(t)
+
+	for name, authorization := range map[string]string{
+		"missing":   "",
+		"raw token": token,
+		"wrong":     "Bearer nope",
+		"basic":     "Basic " + token,
+	} {
+		if rec := apiRequest(t, http.MethodGet, "/api/months", authorization, nil, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%v: expected 401, got %v", name, rec.Code)
+		}
+	}
+
+	rec := apiRequest(t, http.MethodGet, "/api/months", "Bearer "+token, nil, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", rec.Code, rec.Body.String())
+	}
+	apiToken := &ApiToken{}
+	db.First(&apiToken)
+	if apiToken.LastUsedAt == nil {
+		t.Error("expected the token to record its last use")
+	}
+}
+
+func TestApiUploadAndDuplicate(t *testing.T) {
+	setupTestBot(t)
+	token := createTestApiToken(t)
+	contents := readTestdata(t, "invoice_simple.pdf")
+
+	rec := uploadApiInvoice(t, token, "invoice.pdf", contents)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v: %v", rec.Code, rec.Body.String())
+	}
+	result := apiInvoice{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.FileName != "invoice.pdf" || result.Source != SourceApi || result.Sender != "accounting" {
+		t.Errorf("unexpected upload result: %+v", result)
+	}
+
+	rec = uploadApiInvoice(t, token, "again.pdf", contents)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for the same file, got %v: %v", rec.Code, rec.Body.String())
+	}
+	var count int64
+	db.Model(&Invoice{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected 1 invoice, got %v", count)
+	}
+
+	rec = apiRequest(t, http.MethodGet, "/api/months/"+result.BillingMonth+"/invoices", "Bearer "+token, nil, "")
+	listed := []apiInvoice{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != result.ID {
+		t.Errorf("expected the uploaded invoice in the month listing, got %+v", listed)
+	}
+}
+
+func TestApiAcknowledgeMonth(t *testing.T) {
+	setupTestBot(t)
+	token := createTestApiToken(t)
+	db.Create(&NotifiedChat{TelegramChatID: testChatID})
+
+	if rec := apiRequest(t, http.MethodGet, "/api/months/2023-03/acknowledge", "Bearer "+token, nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for GET, got %v", rec.Code)
+	}
+	rec := apiRequest(t, http.MethodPost, "/api/months/2023-03/acknowledge", "Bearer "+token, nil, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", rec.Code, rec.Body.String())
+	}
+	chat := &NotifiedChat{}
+	db.First(&chat)
+	if chat.LastAcknowledgedYear != 2023 || chat.LastAcknowledgedMonth != 3 {
+		t.Errorf("expected the chat to be acknowledged for 2023-03, got %v-%v", chat.LastAcknowledgedYear, chat.LastAcknowledgedMonth)
+	}
+}
+
+func TestWebMuxServesApiWithoutDashboardCredentials(t *testing.T) {
+	setupTestBot(t)
+	token := createTestApiToken(t)
+
+	if rec := apiRequest(t, http.MethodGet, "/", "", nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the dashboard to be disabled, got %v", rec.Code)
+	}
+	if rec := apiRequest(t, http.MethodGet, "/api/months", "Bearer "+token, nil, ""); rec.Code != http.StatusOK {
+		t.Errorf("expected the API to work without dashboard credentials, got %v", rec.Code)
+	}
+
+	config.HttpUsername = "admin"
+	config.HttpPassword = "secret"
+	if rec := apiRequest(t, http.MethodGet, "/", "", nil, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the dashboard to require basic auth, got %v", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	newWebMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the dashboard with basic auth, got %v", rec.Code)
+	}
+}
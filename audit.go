@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditInvoiceUploaded       = "invoice_uploaded"
+	AuditInvoiceMoved          = "invoice_moved"
+	AuditInvoiceDeleted        = "invoice_deleted"
+	AuditInvoiceRenamed        = "invoice_renamed"
+	AuditInvoiceReplaced       = "invoice_replaced"
+	AuditDuplicateResolved     = "duplicate_resolved"
+	AuditInvoiceDownloaded     = "invoice_downloaded"
+	AuditZipGenerated          = "zip_generated"
+	AuditZipSentToAccounting   = "zip_sent_to_accounting"
+	AuditMonthAcknowledged     = "month_acknowledged"
+	AuditNotificationsEnabled  = "notifications_enabled"
+	AuditNotificationsDisabled = "notifications_disabled"
+	AuditUserAuthorized        = "user_authorized"
+	AuditUserRoleChanged       = "user_role_changed"
+	AuditUserRevoked           = "user_revoked"
+	AuditInviteCreated         = "invite_created"
+	AuditApiTokenCreated       = "api_token_created"
+	AuditApiTokenRevoked       = "api_token_revoked"
+)
+
+// number of events shown by /audit
+const auditListLimit = 20
+
+// AuditEvent records who did what, Actor is a human readable description
+// like "telegram @user (123)", "email someone@example.com" or "api erp"
+type AuditEvent struct {
+	gorm.Model
+	Actor  string
+	Action string `gorm:"index"`
+	// 0 when the event is not about a single invoice
+	InvoiceID uint `gorm:"index"`
+	Details   string
+}
+
+// recordAuditEvent stores an event, failures are only logged so that they never block the audited action
+func recordAuditEvent(actor string, action string, invoiceID uint, details string) {
+	event := &AuditEvent{
+		Actor:     actor,
+		Action:    action,
+		InvoiceID: invoiceID,
+		Details:   details,
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("error recording audit event %v by %v: %v", action, actor, err)
+	}
+}
+
+func (u *AuthorizedUser) AuditActor() string {
+	return fmt.Sprintf("telegram %v (%v)", u.DisplayName(), u.TelegramID)
+}
+
+func (e *AuditEvent) String() string {
+	s := fmt.Sprintf("%v %v: %v", e.CreatedAt.Format("2006-01-02 15:04"), e.Actor, e.Action)
+	if e.InvoiceID != 0 {
+		s += fmt.Sprintf(" #%v", e.InvoiceID)
+	}
+	if e.Details != "" {
+		s += " – " + e.Details
+	}
+	return s
+}
+
+// exportAuditEventsCsv returns every audit event as a CSV file
+func exportAuditEventsCsv() ([]byte, error) {
+	var events []AuditEvent
+	if err := db.Order("id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	// the BOM makes spreadsheet software detect the file as UTF-8
+	buf.WriteString("\ufeff")
+	csvWriter := csv.NewWriter(buf)
+	csvWriter.Write([]string{"time", "actor", "action", "invoice_id", "details"})
+	for _, event := range events {
+		invoiceID := ""
+		if event.InvoiceID != 0 {
+			invoiceID = strconv.FormatUint(uint64(event.InvoiceID), 10)
+		}
+		csvWriter.Write([]string{
+			event.CreatedAt.Format("2006-01-02 15:04:05"),
+			event.Actor,
+			event.Action,
+			invoiceID,
+			event.Details,
+		})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleAuditCommand implements /audit:
+//
+//	/audit          shows the most recent events
+//	/audit #ID      shows the events of an invoice
+//	/audit export   sends every event as a CSV file
+func handleAuditCommand(chatID int64, messageID int, args string) {
+	args = strings.TrimSpace(args)
+	if args == "export" {
+		contents, err := exportAuditEventsCsv()
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		doc := OutgoingDocument{
+			FileName: fmt.Sprintf("GK_audit_%v.csv", time.Now().Format("2006-01-02")),
+			Contents: contents,
+		}
+		if err := messenger.SendDocuments(chatID, messageID, []OutgoingDocument{doc}); err != nil {
+			sendError(chatID, err)
+		}
+		return
+	}
+	query := db.Order("id DESC").Limit(auditListLimit)
+	title := "Recent events"
+	if args != "" {
+		invoiceID, err := strconv.Atoi(strings.TrimPrefix(args, "#"))
+		if err != nil {
+			sendError(chatID, fmt.Errorf("usage: /audit [#invoice id | export]"))
+			return
+		}
+		query = query.Where("invoice_id = ?", invoiceID)
+		title = fmt.Sprintf("Events of invoice #%v", invoiceID)
+	}
+	var events []AuditEvent
+	if err := query.Find(&events).Error; err != nil {
+		sendError(chatID, err)
+		return
+	}
+	if len(events) == 0 {
+		replyText(chatID, messageID, "No audit events found")
+		return
+	}
+	eventsStr := ""
+	// oldest first, like a log
+	for i := len(events) - 1; i >= 0; i-- {
+		eventsStr += events[i].String() + "\n"
+	}
+	replyText(chatID, messageID, title+":\n"+eventsStr)
+}
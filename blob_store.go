@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var sha256HexRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// blobPath returns the location of a blob in the content-addressed store,
+// e.g. <storage dir>/blobs/ab/cdef...
+func blobPath(sha string) (string, error) {
+	if !sha256HexRegex.MatchString(sha) {
+		return "", fmt.Errorf("invalid blob hash: %q", sha)
+	}
+	return filepath.Join(config.StorageDir, "blobs", sha[:2], sha[2:]), nil
+}
+
+// writeBlob stores contents under their sha256 and returns the hash.
+// Writing a blob which is already stored is a no-op.
+func writeBlob(contents []byte) (string, error) {
+	sha := fmt.Sprintf("%x", sha256.Sum256(contents))
+	path, err := blobPath(sha)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return sha, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// write to a temporary file first so that a crash never leaves a truncated blob behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return sha, nil
+}
+
+func openBlob(sha string) (*os.File, error) {
+	path, err := blobPath(sha)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func readBlob(sha string) ([]byte, error) {
+	path, err := blobPath(sha)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// migrateInvoiceBlobs moves invoice contents which used to be stored in the
+// invoices.contents column to the blob store and drops the column.
+func migrateInvoiceBlobs() error {
+	if !db.Migrator().HasColumn(&Invoice{}, "contents") {
+		return nil
+	}
+	log.Printf("moving invoice contents from the database to the blob store...")
+	rows, err := db.Raw("SELECT id, sha256, contents FROM invoices WHERE contents IS NOT NULL").Rows()
+	if err != nil {
+		return err
+	}
+	type blobToMove struct {
+		id     uint
+		sha256 string
+	}
+	moved := []blobToMove{}
+	for rows.Next() {
+		var id uint
+		var storedSha string
+		var contents []byte
+		if err := rows.Scan(&id, &storedSha, &contents); err != nil {
+			rows.Close()
+			return err
+		}
+		sha, err := writeBlob(contents)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error writing blob of invoice %v: %v", id, err)
+		}
+		if sha != storedSha {
+			log.Printf("invoice %v has sha256 %v stored, but its contents hash to %v", id, storedSha, sha)
+		}
+		moved = append(moved, blobToMove{id: id, sha256: sha})
+	}
+	rows.Close()
+	for _, m := range moved {
+		if err := db.Exec("UPDATE invoices SET sha256 = ?, contents = NULL WHERE id = ?", m.sha256, m.id).Error; err != nil {
+			return err
+		}
+	}
+	if err := db.Migrator().DropColumn(&Invoice{}, "contents"); err != nil {
+		return fmt.Errorf("error dropping invoices.contents: %v", err)
+	}
+	if err := db.Exec("VACUUM").Error; err != nil {
+		return err
+	}
+	log.Printf("moved %v invoices to the blob store", len(moved))
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// the tables as the first version of the bot created them, with the invoices in the database
+type baselineAuthorizedUser struct {
+	gorm.Model
+	TelegramID int64
+	UserName   string
+}
+
+func (baselineAuthorizedUser) TableName() string { return "authorized_users" }
+
+type baselineInvoice struct {
+	gorm.Model
+	FileName string
+	Contents []byte `gorm:"type:blob"`
+	Sha256   string
+}
+
+func (baselineInvoice) TableName() string { return "invoices" }
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	dir := t.TempDir()
+	config = Config{StorageDir: dir}
+	var err error
+	db, err = gorm.Open(sqlite.Open(dir+"/test.db"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&baselineAuthorizedUser{}, &baselineInvoice{}); err != nil {
+		t.Fatal(err)
+	}
+	// running /authorize twice used to add the user twice
+	db.Create(&baselineAuthorizedUser{TelegramID: testUserID, UserName: "tester"})
+	db.Create(&baselineAuthorizedUser{TelegramID: testUserID, UserName: "tester"})
+	invoices := []*baselineInvoice{
+		{FileName: "faktura.pdf", Contents: readTestdata(t, "invoice_simple.pdf")},
+		{FileName: "faktura.xml", Contents: readTestdata(t, "invoice_ksef.xml")},
+		// a hash which doesn't match the contents is fixed by the migration
+		{FileName: "wrong.pdf", Contents: []byte("%PDF-1.4 wrong hash"), Sha256: "0000"},
+	}
+	for _, invoice := range invoices {
+		if invoice.Sha256 == "" {
+			invoice.Sha256 = fmt.Sprintf("%x", sha256.Sum256(invoice.Contents))
+		}
+		if err := db.Create(invoice).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Migrator().HasColumn(&Invoice{}, "contents") {
+		t.Error("expected invoices.contents to be dropped")
+	}
+	for _, old := range invoices {
+		invoice := &Invoice{}
+		if err := db.First(&invoice, old.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%x", sha256.Sum256(old.Contents)); invoice.Sha256 != want {
+			t.Errorf("invoice %v has sha256 %v, want %v", invoice.FileName, invoice.Sha256, want)
+		}
+		contents, err := readBlob(invoice.Sha256)
+		if err != nil {
+			t.Fatalf("error reading the blob of %v: %v", invoice.FileName, err)
+		}
+		if !bytes.Equal(contents, old.Contents) {
+			t.Errorf("the blob of %v doesn't match its old contents", invoice.FileName)
+		}
+		if invoice.BillingYear != invoice.CreatedAt.Year() || invoice.BillingMonth != int(invoice.CreatedAt.Month()) {
+			t.Errorf("expected %v to be billed in its upload month, got %v", invoice.FileName, invoice.BillingPeriod())
+		}
+	}
+
+	users := []AuthorizedUser{}
+	db.Find(&users)
+	if len(users) != 1 || users[0].Role != RoleAdmin {
+		t.Errorf("expected a single admin, got %+v", users)
+	}
+	// the moved invoices are indexed for search
+	found, err := searchInvoices("hosting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].FileName != "faktura.xml" {
+		t.Errorf("expected the XML invoice to be found, got %v", found)
+	}
+
+	// migrating again is a no-op
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+}
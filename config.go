@@ -7,13 +7,37 @@ import (
 )
 
 type Config struct {
-	TelegramToken      string `json:"telegram_token"`
-	StorageDir         string `json:"storage_dir"`
-	NagInterval        string `json:"nag_interval"`
-	ImapAddress        string `json:"imap_address"`
-	ImapUsername       string `json:"imap_username"`
-	ImapPassword       string `json:"imap_password"`
+	TelegramToken string `json:"telegram_token"`
+	StorageDir    string `json:"storage_dir"`
+	NagInterval   string `json:"nag_interval"`
+	// a single mail account, MailAccounts configures more
+	ImapAddress  string `json:"imap_address"`
+	ImapUsername string `json:"imap_username"`
+	ImapPassword string `json:"imap_password"`
+	// wait for new mail with IMAP IDLE instead of checking every EmailCheckInterval
+	EmailIdle    bool           `json:"email_idle"`
+	MailAccounts []*MailAccount `json:"mail_accounts"`
+	// the default check interval of the mail accounts
 	EmailCheckInterval string `json:"email_check_interval"`
+	// what to do with handled e-mails: leave (the default), flag, move or delete, see email_actions.go
+	EmailProcessedAction string `json:"email_processed_action"`
+	EmailProcessedFolder string `json:"email_processed_folder"`
+	// the same for e-mails which couldn't be handled
+	EmailFailedAction string `json:"email_failed_action"`
+	EmailFailedFolder string `json:"email_failed_folder"`
+
+	// outgoing mail, used to send the monthly packages to AccountingEmail
+	SmtpAddress     string `json:"smtp_address"`
+	SmtpUsername    string `json:"smtp_username"`
+	SmtpPassword    string `json:"smtp_password"`
+	SmtpFrom        string `json:"smtp_from"`
+	AccountingEmail string `json:"accounting_email"`
+
+	// the web server with the API is only started when HttpListenAddress is set,
+	// the dashboard also needs HttpUsername and HttpPassword
+	HttpListenAddress string `json:"http_listen_address"`
+	HttpUsername      string `json:"http_username"`
+	HttpPassword      string `json:"http_password"`
 
 	NotificationsStartTime *TimeOfDay `json:"notifications_start_time"`
 	NotificationsEndTime   *TimeOfDay `json:"notifications_end_time"`
@@ -42,5 +66,8 @@ func loadConfig() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := validateMailAccounts(); err != nil {
+		return err
+	}
+	return validateEmailActions()
 }
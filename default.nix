@@ -17,4 +17,6 @@ pkgs.buildGoApplication {
   pwd = ./.;
   src = ./.;
   modules = ./gomod2nix.toml;
+  # full-text search for /search
+  tags = [ "sqlite_fts5" ];
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// normalizedTextSha256 hashes the text of an invoice ignoring case, whitespace and
+// punctuation, so that the same invoice rendered again gets the same hash
+func normalizedTextSha256(text string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, text)
+	if normalized == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(normalized)))
+}
+
+// findLikelyDuplicate looks for a stored invoice with the same number, seller and
+// gross amount, or with the same normalized text. It returns nil if there is none.
+func findLikelyDuplicate(invoice *Invoice) (*Invoice, error) {
+	conditions := []string{}
+	args := []any{}
+	if invoice.InvoiceNumber != "" && invoice.SellerNIP != "" && invoice.GrossAmount != nil {
+		conditions = append(conditions, "(invoice_number = ? AND seller_nip = ? AND gross_amount = ?)")
+		args = append(args, invoice.InvoiceNumber, invoice.SellerNIP, *invoice.GrossAmount)
+	}
+	if invoice.TextSha256 != "" {
+		conditions = append(conditions, "text_sha256 = ?")
+		args = append(args, invoice.TextSha256)
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	duplicate := &Invoice{}
+	err := db.Where(strings.Join(conditions, " OR "), args...).Where("id <> ?", invoice.ID).Order("id").First(&duplicate).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return duplicate, nil
+}
+
+// backfillTextHashes computes the normalized text hashes of invoices stored before they existed
+func backfillTextHashes() error {
+	var searchTexts []InvoiceSearchText
+	err := db.Where("text <> '' AND invoice_id IN (SELECT id FROM invoices WHERE text_sha256 IS NULL OR text_sha256 = '')").Find(&searchTexts).Error
+	if err != nil {
+		return err
+	}
+	for _, searchText := range searchTexts {
+		err := db.Model(&Invoice{}).Unscoped().Where("id = ?", searchText.InvoiceID).
+			Update("text_sha256", normalizedTextSha256(searchText.Text)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// duplicateQuestion asks what to do with an invoice which looks like a duplicate
+func duplicateQuestion(invoice *Invoice, original *Invoice) OutgoingMessage {
+	prefix := fmt.Sprintf("/duplicate %v ", invoice.ID)
+	return OutgoingMessage{
+		Text: fmt.Sprintf("⚠️ Invoice <b>#%v %v</b> looks like a duplicate of <b>#%v %v</b> from %v. What should I do with it?",
+			invoice.ID, html.EscapeString(invoice.FileName), original.ID, html.EscapeString(original.FileName), original.BillingPeriod()),
+		ParseMode: "HTML",
+		Buttons: [][]MessageButton{{
+			{Text: "Keep both", Data: prefix + "keep"},
+			{Text: fmt.Sprintf("Replace #%v", original.ID), Data: prefix + "replace"},
+			{Text: "Discard new", Data: prefix + "discard"},
+		}},
+	}
+}
+
+// askAboutDuplicate sends the duplicate question to a chat, or to every notified chat if chatID is 0
+func askAboutDuplicate(chatID int64, replyToMessageID int, invoice *Invoice) {
+	if invoice.DuplicateOfID == nil {
+		return
+	}
+	original := &Invoice{}
+	if err := db.First(&original, *invoice.DuplicateOfID).Error; err != nil {
+		log.Printf("error loading the original of duplicate invoice #%v: %v", invoice.ID, err)
+		return
+	}
+	question := duplicateQuestion(invoice, original)
+	if chatID == 0 {
+		notifyAllChatsWithButtons(question.Text, question.Buttons)
+		return
+	}
+	question.ChatID = chatID
+	question.ReplyToMessageID = replyToMessageID
+	messenger.SendText(question)
+}
+
+// handleDuplicateCommand resolves a likely duplicate:
+//
+//	/duplicate <id> keep      keeps both invoices
+//	/duplicate <id> replace   keeps the new invoice and deletes the original
+//	/duplicate <id> discard   deletes the new invoice
+func handleDuplicateCommand(chatID int64, messageID int, args string, user *AuthorizedUser) {
+	parts := strings.Fields(args)
+	if len(parts) != 2 {
+		sendError(chatID, fmt.Errorf("usage: /duplicate <invoice id> keep|replace|discard"))
+		return
+	}
+	invoiceID, err := strconv.Atoi(strings.TrimPrefix(parts[0], "#"))
+	if err != nil {
+		sendError(chatID, fmt.Errorf("invalid invoice id: %v", parts[0]))
+		return
+	}
+	invoice := &Invoice{}
+	if err := db.First(&invoice, invoiceID).Error; err != nil {
+		sendError(chatID, fmt.Errorf("invoice #%v not found, it might have been discarded already", invoiceID))
+		return
+	}
+	if invoice.DuplicateOfID == nil {
+		replyText(chatID, messageID, fmt.Sprintf("Invoice #%v is not marked as a duplicate anymore", invoice.ID))
+		return
+	}
+	originalID := *invoice.DuplicateOfID
+	var reply string
+	switch parts[1] {
+	case "keep":
+		reply = fmt.Sprintf("Keeping both invoices #%v and #%v", originalID, invoice.ID)
+	case "replace":
+		original := &Invoice{}
+		if err := db.First(&original, originalID).Error; err == nil {
+			if err := deleteInvoice(original, user.AuditActor()); err != nil {
+				sendError(chatID, err)
+				return
+			}
+		}
+		// other copies of the original now look like copies of this invoice
+		if err := db.Model(&Invoice{}).Where("duplicate_of_id = ?", originalID).Update("duplicate_of_id", invoice.ID).Error; err != nil {
+			sendError(chatID, err)
+			return
+		}
+		reply = fmt.Sprintf("Invoice #%v deleted, keeping #%v %v", originalID, invoice.ID, invoice.FileName)
+	case "discard":
+		if err := deleteInvoice(invoice, user.AuditActor()); err != nil {
+			sendError(chatID, err)
+			return
+		}
+		reply = fmt.Sprintf("Invoice #%v %v discarded, keeping #%v", invoice.ID, invoice.FileName, originalID)
+	default:
+		sendError(chatID, fmt.Errorf("unknown action: %v (expected keep, replace or discard)", parts[1]))
+		return
+	}
+	if parts[1] != "discard" {
+		if err := db.Model(&invoice).Update("duplicate_of_id", nil).Error; err != nil {
+			sendError(chatID, err)
+			return
+		}
+	}
+	recordAuditEvent(user.AuditActor(), AuditDuplicateResolved, invoice.ID, fmt.Sprintf("%v, duplicate of #%v", parts[1], originalID))
+	replyText(chatID, messageID, reply)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFindLikelyDuplicateByMetadata(t *testing.T) {
+	setupTestBot(t)
+	gross := int64(123000)
+	original := &Invoice{FileName: "faktura.pdf", Sha256: "a", InvoiceNumber: "FV/1/2023", SellerNIP: "5261040828", GrossAmount: &gross}
+	if err := db.Create(original).Error; err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		invoice Invoice
+		want    bool
+	}{
+		{"same number, seller and amount", Invoice{InvoiceNumber: "FV/1/2023", SellerNIP: "5261040828", GrossAmount: &gross}, true},
+		{"other seller", Invoice{InvoiceNumber: "FV/1/2023", SellerNIP: "1234563218", GrossAmount: &gross}, false},
+		{"no amount", Invoice{InvoiceNumber: "FV/1/2023", SellerNIP: "5261040828"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duplicate, err := findLikelyDuplicate(&tt.invoice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (duplicate != nil) != tt.want || (duplicate != nil && duplicate.ID != original.ID) {
+				t.Fatalf("got %+v, want a duplicate: %v", duplicate, tt.want)
+			}
+		})
+	}
+}
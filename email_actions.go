@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/emersion/go-imap"
+)
+
+// what happens to an e-mail after the bot has handled it
+const (
+	EmailActionLeave  = "leave"
+	EmailActionFlag   = "flag"
+	EmailActionMove   = "move"
+	EmailActionDelete = "delete"
+)
+
+type emailAction struct {
+	Action string
+	// the mailbox messages are moved to, only for EmailActionMove
+	Folder string
+}
+
+func newEmailAction(action string, folder string, defaultFolder string) emailAction {
+	if action == "" {
+		action = EmailActionLeave
+	}
+	if folder == "" {
+		folder = defaultFolder
+	}
+	return emailAction{Action: action, Folder: folder}
+}
+
+// processedEmailAction is applied to e-mails which were handled without errors
+func processedEmailAction() emailAction {
+	return newEmailAction(config.EmailProcessedAction, config.EmailProcessedFolder, "Processed")
+}
+
+// failedEmailAction is applied to e-mails which couldn't be handled
+func failedEmailAction() emailAction {
+	return newEmailAction(config.EmailFailedAction, config.EmailFailedFolder, "Failed")
+}
+
+func validateEmailActions() error {
+	for _, action := range []emailAction{processedEmailAction(), failedEmailAction()} {
+		switch action.Action {
+		case EmailActionLeave, EmailActionFlag, EmailActionMove, EmailActionDelete:
+		default:
+			return fmt.Errorf("unknown e-mail action %q, expected leave, flag, move or delete", action.Action)
+		}
+	}
+	return nil
+}
+
+// createActionFolders creates the mailboxes e-mails are moved to if they don't exist yet
+func createActionFolders(conn MailSource) error {
+	mailboxes, err := conn.ListMailboxes()
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, name := range mailboxes {
+		existing[name] = true
+	}
+	for _, action := range []emailAction{processedEmailAction(), failedEmailAction()} {
+		if action.Action != EmailActionMove || existing[action.Folder] {
+			continue
+		}
+		log.Printf("Creating mailbox %v", action.Folder)
+		if err := conn.CreateMailbox(action.Folder); err != nil {
+			return fmt.Errorf("error creating mailbox %v: %v", action.Folder, err)
+		}
+		existing[action.Folder] = true
+	}
+	return nil
+}
+
+// applyEmailAction does whatever is configured with a message of the selected mailbox
+func applyEmailAction(conn MailSource, uid uint32, action emailAction) error {
+	switch action.Action {
+	case EmailActionFlag:
+		return conn.AddFlag(uid, imap.FlaggedFlag)
+	case EmailActionMove:
+		return conn.MoveMessage(uid, action.Folder)
+	case EmailActionDelete:
+		if err := conn.AddFlag(uid, imap.DeletedFlag); err != nil {
+			return err
+		}
+		return conn.Expunge()
+	}
+	return nil
+}
@@ -1,78 +1,169 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
-	"sync"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message"
 )
 
-var emailCheckMutex sync.Mutex
-
-func setupEmailConn() (*client.Client, error) {
-	conn, err := client.DialTLS(config.ImapAddress, nil)
-	if err != nil {
-		return nil, err
-	}
-	if err := conn.Login(config.ImapUsername, config.ImapPassword); err != nil {
-		return nil, err
-	}
-	return conn, nil
-}
-
 type AttachmentToHandle struct {
 	SenderEmail string
 	Subject     string
+	MessageID   string
 	FileName    string
 	MimeType    string
-	Content     []byte
-	CC          []string
-	To          []string
+	// set for parts shown in the message body, like logos in signatures
+	Inline  bool
+	Content []byte
+	CC      []string
+	To      []string
 }
 
-func handleEmailAttachment(attachment AttachmentToHandle) error {
-	log.Printf("Handling email attachment: %v, %v", attachment.MimeType, attachment.FileName)
-	if attachment.MimeType == "application/pdf" {
-		err := processIncomingInvoice(attachment.FileName, attachment.Content)
-		errStr := "success"
+// limits for unpacking ZIP attachments which aren't our own packages
+const (
+	maxZipEntries   = 100
+	maxZipEntrySize = 20 << 20
+)
+
+// invoiceAttachmentKind returns "invoice" for attachments stored as invoices, "zip" for ZIP
+// archives and "" for everything else. Mail clients often send files as
+// application/octet-stream, so the file extension is checked too.
+func invoiceAttachmentKind(mimeType string, fileName string) string {
+	switch strings.ToLower(mimeType) {
+	case "application/pdf", "application/xml", "text/xml", "image/jpeg", "image/png":
+		return "invoice"
+	case "application/zip", "application/x-zip-compressed":
+		return "zip"
+	}
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".pdf", ".xml", ".jpg", ".jpeg", ".png":
+		return "invoice"
+	case ".zip":
+		return "zip"
+	}
+	return ""
+}
+
+// unpackZipAttachment handles every supported file of a ZIP archive as a separate attachment,
+// the files after one which couldn't be stored are still handled
+func unpackZipAttachment(attachment AttachmentToHandle) error {
+	reader, err := zip.NewReader(bytes.NewReader(attachment.Content), int64(len(attachment.Content)))
+	if err != nil {
+		log.Printf("Ignoring %v, not a valid ZIP file: %v", attachment.FileName, err)
+		return nil
+	}
+	entries := 0
+	var firstErr error
+	for _, f := range reader.File {
+		name := path.Base(f.Name)
+		// nested archives are not unpacked
+		if f.FileInfo().IsDir() || invoiceAttachmentKind("", name) != "invoice" {
+			continue
+		}
+		if entries >= maxZipEntries {
+			log.Printf("Skipping the rest of %v, more than %v files", attachment.FileName, maxZipEntries)
+			break
+		}
+		entries++
+		if f.UncompressedSize64 > maxZipEntrySize {
+			log.Printf("Skipping %v in %v, too large", f.Name, attachment.FileName)
+			continue
+		}
+		r, err := f.Open()
 		if err != nil {
-			errStr = err.Error()
+			return fmt.Errorf("error opening %v in %v: %v", f.Name, attachment.FileName, err)
+		}
+		content, err := io.ReadAll(io.LimitReader(r, maxZipEntrySize))
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("error reading %v in %v: %v", f.Name, attachment.FileName, err)
+		}
+		entry := attachment
+		entry.FileName = name
+		entry.MimeType = ""
+		entry.Content = content
+		if err := handleInvoiceAttachment(entry); err != nil && firstErr == nil {
+			firstErr = err
 		}
-		notificationText := fmt.Sprintf(
-			`Received e-mail invoice:
+	}
+	return firstErr
+}
+
+// handleInvoiceAttachment stores an invoice received by e-mail and notifies the chats about it.
+// It returns the error if the invoice couldn't be stored, a known invoice isn't an error.
+func handleInvoiceAttachment(attachment AttachmentToHandle) error {
+	invoice, err := processIncomingInvoice(attachment.FileName, attachment.Content, newEmailInvoiceSource(attachment))
+	errStr := "success"
+	if err != nil {
+		errStr = err.Error()
+	}
+	notificationText := fmt.Sprintf(
+		`Received e-mail invoice:
 File name: <b>%v</b>
 Subject: <b>%v</b>
 Sender: <b>%v</b>
 Processing result: <b>%v</b>
 			`,
-			attachment.FileName, attachment.Subject, attachment.SenderEmail, errStr)
-
-		notifyAllChats(notificationText)
+		attachment.FileName, attachment.Subject, attachment.SenderEmail, errStr)
+	if invoice != nil {
+		notificationText = strings.TrimRight(notificationText, " \t")
+		notificationText += fmt.Sprintf("Billing month: <b>%v</b>\n", invoice.BillingPeriod())
+		if isXmlInvoice(attachment.Content) {
+			// XML invoices aren't readable as files, so show what's in them
+			if summary, _, err := readKsefInvoice(attachment.Content); err == nil {
+				notificationText += "<pre>" + html.EscapeString(summary) + "</pre>\n"
+			}
+		} else if summary := invoice.MetadataSummary(); summary != "" {
+			notificationText += html.EscapeString(summary) + "\n"
+		}
+		if warning := lateInvoiceWarning(invoice); warning != "" {
+			notificationText += "\n<b>" + html.EscapeString(warning) + "</b>"
+		}
+	}
 
-		return nil
+	notifyAllChats(notificationText)
+	if invoice != nil {
+		askAboutDuplicate(0, 0, invoice)
 	}
-	if attachment.MimeType == "application/zip" {
+	if err != nil && !errors.Is(err, ErrInvoiceExists) {
+		return fmt.Errorf("error storing %v: %v", attachment.FileName, err)
+	}
+	return nil
+}
+
+func handleEmailAttachment(attachment AttachmentToHandle) error {
+	log.Printf("Handling email attachment: %v, %v", attachment.MimeType, attachment.FileName)
+	actor := "email " + attachment.SenderEmail
+	switch invoiceAttachmentKind(attachment.MimeType, attachment.FileName) {
+	case "invoice":
+		if attachment.Inline && strings.HasPrefix(attachment.MimeType, "image/") {
+			log.Printf("Skipping inline image %v", attachment.FileName)
+			return nil
+		}
+		return handleInvoiceAttachment(attachment)
+	case "zip":
 		// calculate sha256 of the zip file
 		sha265 := fmt.Sprintf("%x", sha256.Sum256(attachment.Content))
-		// check if we know this zip file
+		// check if we know this zip file, anything else is a bundle of invoices
 		zipFile := &GeneratedZip{}
 		if err := db.Where("sha256 = ?", sha265).First(&zipFile).Error; err != nil {
-			return nil
+			return unpackZipAttachment(attachment)
 		}
 		// if we know this zip file, update LastAcknowledgedYear and LastAcknowledgedMonth for every notified chat
 		// and send a notification to the chat
-		err := db.Model(&NotifiedChat{}).Where("1 = 1").Updates(NotifiedChat{
-			LastAcknowledgedMonth: zipFile.Month,
-			LastAcknowledgedYear:  zipFile.Year,
-		}).Error
-		if err != nil {
+		if err := acknowledgeMonth(zipFile.Year, zipFile.Month, actor); err != nil {
 			return fmt.Errorf("error updating notified chats: %v", err)
 		}
 
@@ -95,153 +186,338 @@ CC, To: <b>`, attachment.FileName, attachment.SenderEmail, zipFile.Year, zipFile
 type EmailCheckStats struct {
 	EmailsChecked int
 	Attachments   int
+	// messages which couldn't be handled, they are not retried
+	Failed int
+}
+
+func (s *EmailCheckStats) Add(other *EmailCheckStats) {
+	s.EmailsChecked += other.EmailsChecked
+	s.Attachments += other.Attachments
+	s.Failed += other.Failed
+}
+
+func (s *EmailCheckStats) String() string {
+	text := fmt.Sprintf("checked %v emails, found %v attachments", s.EmailsChecked, s.Attachments)
+	if s.Failed > 0 {
+		text += fmt.Sprintf(", %v emails could not be handled (see the logs)", s.Failed)
+	}
+	return text
+}
+
+// handleEmailMessage handles every attachment of a fetched message and returns how many there were
+func handleEmailMessage(msg *imap.Message) (int, error) {
+	attachments := 0
+	if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+		return 0, fmt.Errorf("message %v has no sender", msg.Uid)
+	}
+	log.Printf("Message: %v", msg.Envelope.Subject)
+	// fetch it's attachments
+	for _, p := range msg.Body {
+		if p == nil {
+			continue
+		}
+		entity, err := message.Read(p)
+		if err != nil {
+			return attachments, err
+		}
+
+		multiPartReader := entity.MultipartReader()
+
+		if multiPartReader == nil {
+			continue
+		}
+
+		for e, err := multiPartReader.NextPart(); err != io.EOF; e, err = multiPartReader.NextPart() {
+			if err != nil {
+				return attachments, err
+			}
+			kind, params, cErr := e.Header.ContentType()
+			if cErr != nil {
+				return attachments, cErr
+			}
+			log.Printf("Part: %v, %v", kind, params)
+			if kind == "multipart/alternative" {
+				continue
+			}
+			disposition, dispositionParams, _ := e.Header.ContentDisposition()
+			fileName := params["name"]
+			if fileName == "" {
+				fileName = dispositionParams["filename"]
+			}
+			attachmentToProcess := &AttachmentToHandle{
+				SenderEmail: msg.Envelope.From[0].MailboxName + "@" + msg.Envelope.From[0].HostName,
+				Subject:     msg.Envelope.Subject,
+				MessageID:   msg.Envelope.MessageId,
+				FileName:    fileName,
+				MimeType:    kind,
+				Inline:      disposition == "inline",
+				CC:          []string{},
+				To:          []string{},
+			}
+			for _, cc := range msg.Envelope.Cc {
+				attachmentToProcess.CC = append(attachmentToProcess.CC, cc.MailboxName+"@"+cc.HostName)
+			}
+			for _, to := range msg.Envelope.To {
+				attachmentToProcess.To = append(attachmentToProcess.To, to.MailboxName+"@"+to.HostName)
+			}
+			attachmentToProcess.Content, err = io.ReadAll(e.Body)
+			if err != nil {
+				return attachments, err
+			}
+			err = handleEmailAttachment(*attachmentToProcess)
+			if err != nil {
+				return attachments, err
+			}
+			attachments++
+		}
+	}
+	return attachments, nil
 }
 
-// trashy golang function to fetch all email attachments
-func doCheckEmail() (*EmailCheckStats, error) {
-	emailCheckMutex.Lock()
-	defer emailCheckMutex.Unlock()
+// findMailboxState returns the stored state of a mailbox, or a new one if it was never checked
+func findMailboxState(account string, mailbox string) (*MailboxState, error) {
+	state := &MailboxState{Account: account, Mailbox: mailbox}
+	err := db.Where("account = ? AND mailbox = ?", account, mailbox).Limit(1).Find(state).Error
+	return state, err
+}
+
+// newMessageUids returns the sorted UIDs of the messages which arrived after lastUid
+func newMessageUids(conn MailSource, lastUid uint32) ([]uint32, error) {
+	uidset := new(imap.SeqSet)
+	uidset.AddRange(lastUid+1, 0)
+	messages, err := conn.UidFetch(uidset, []imap.FetchItem{imap.FetchUid})
+	if err != nil {
+		return nil, err
+	}
+	uids := []uint32{}
+	for _, msg := range messages {
+		// "n:*" always matches the last message, even when its UID is lower than n
+		if msg.Uid > lastUid {
+			uids = append(uids, msg.Uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// checkMailFolder handles every message which arrived in a folder since the last check. The UID
+// of the last handled message is stored, so nothing is handled twice and nothing is skipped.
+func checkMailFolder(account *MailAccount, folder string) (*EmailCheckStats, error) {
+	account.status.checkMutex.Lock()
+	defer account.status.checkMutex.Unlock()
 	stats := &EmailCheckStats{}
-	log.Printf("Checking email...")
-	conn, err := setupEmailConn()
+	log.Printf("Checking email of %v in %v...", account.DisplayName(), folder)
+	conn, err := dialMailSource(account)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Logout()
+	defer conn.Close()
 	log.Printf("Connected to email server")
 
-	mbox, err := conn.Select("INBOX", false)
+	mbox, err := conn.SelectMailbox(folder)
 	if err != nil {
-		return nil, fmt.Errorf("error selecting INBOX: %v", err)
-	}
-	log.Printf("Found %d messages", mbox.Messages)
-	if mbox.Messages == 0 {
-		return stats, nil
-	}
-	// fetch the new messages
-	seqset := new(imap.SeqSet)
-	from := uint32(1)
-	if mbox.Messages > 10 {
-		from = mbox.Messages - 10
-	}
-
-	seqset.AddRange(from, mbox.Messages)
-	messages := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-	go func() {
-		done <- conn.Fetch(seqset, []imap.FetchItem{imap.FetchRFC822, imap.FetchEnvelope}, messages)
-	}()
-	select {
-	case err := <-done:
+		return nil, fmt.Errorf("error selecting %v: %v", folder, err)
+	}
+	if err := createActionFolders(conn); err != nil {
+		return nil, err
+	}
+	state, err := findMailboxState(account.DisplayName(), folder)
+	if err != nil {
+		return nil, fmt.Errorf("error loading mailbox state: %v", err)
+	}
+	// the UIDs are meaningless once UIDVALIDITY changes, so every message is new again
+	if state.UidValidity != mbox.UidValidity {
+		if state.UidValidity != 0 {
+			log.Printf("UIDVALIDITY of %v changed from %v to %v, checking every message again", folder, state.UidValidity, mbox.UidValidity)
+		}
+		state.UidValidity = mbox.UidValidity
+		state.LastUid = 0
+	}
+	log.Printf("Found %d messages, last handled UID %v", mbox.Messages, state.LastUid)
+	uids := []uint32{}
+	if mbox.Messages > 0 {
+		uids, err = newMessageUids(conn, state.LastUid)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error listing new messages: %v", err)
 		}
-	case <-time.After(10 * time.Second):
-		return nil, errors.New("Timeout")
 	}
-	for msg := range messages {
-		stats.EmailsChecked++
-		log.Printf("Message: %v", msg.Envelope.Subject)
-		// fetch it's attachments
-		for _, p := range msg.Body {
-			if p == nil {
-				continue
-			}
-			entity, err := message.Read(p)
+	for _, uid := range uids {
+		uidset := new(imap.SeqSet)
+		uidset.AddNum(uid)
+		messages, err := conn.UidFetch(uidset, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822, imap.FetchEnvelope})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching message %v: %v", uid, err)
+		}
+		for _, msg := range messages {
+			stats.EmailsChecked++
+			attachments, err := handleEmailMessage(msg)
+			stats.Attachments += attachments
+			action := processedEmailAction()
 			if err != nil {
-				return nil, err
+				log.Printf("Error handling message %v: %v", uid, err)
+				stats.Failed++
+				action = failedEmailAction()
 			}
-
-			multiPartReader := entity.MultipartReader()
-
-			if multiPartReader == nil {
-				continue
+			if err := applyEmailAction(conn, uid, action); err != nil {
+				log.Printf("Error applying action %v to message %v: %v", action.Action, uid, err)
 			}
+		}
+		state.LastUid = uid
+		if err := db.Save(state).Error; err != nil {
+			return nil, fmt.Errorf("error saving mailbox state: %v", err)
+		}
+	}
+	if err := db.Save(state).Error; err != nil {
+		return nil, fmt.Errorf("error saving mailbox state: %v", err)
+	}
+	log.Printf("Done checking email")
+	return stats, nil
+}
 
-			for e, err := multiPartReader.NextPart(); err != io.EOF; e, err = multiPartReader.NextPart() {
-				kind, params, cErr := e.Header.ContentType()
-				if cErr != nil {
-					return nil, cErr
-				}
-				log.Printf("Part: %v, %v", kind, params)
-				if kind == "multipart/alternative" {
-					continue
-				}
-				attachmentToProcess := &AttachmentToHandle{
-					SenderEmail: msg.Envelope.From[0].MailboxName + "@" + msg.Envelope.From[0].HostName,
-					Subject:     msg.Envelope.Subject,
-					FileName:    params["name"],
-					MimeType:    kind,
-					CC:          []string{},
-					To:          []string{},
-				}
-				for _, cc := range msg.Envelope.Cc {
-					attachmentToProcess.CC = append(attachmentToProcess.CC, cc.MailboxName+"@"+cc.HostName)
-				}
-				for _, to := range msg.Envelope.To {
-					attachmentToProcess.To = append(attachmentToProcess.To, to.MailboxName+"@"+to.HostName)
-				}
-				attachmentToProcess.Content, err = io.ReadAll(e.Body)
-				if err != nil {
-					return nil, err
-				}
-				err = handleEmailAttachment(*attachmentToProcess)
-				if err != nil {
-					return nil, err
-				}
-				stats.Attachments++
-
-			}
+func runEmailCheckerLoop() {
+	for _, account := range mailAccounts() {
+		go runMailAccountLoop(account)
+	}
+}
 
+// runMailAccountLoop checks an account for new mail until the bot exits
+func runMailAccountLoop(account *MailAccount) {
+	waitForMailAccount(account)
+	if account.Idle {
+		account.setIdle(true)
+		// IDLE watches a single mailbox per connection
+		for _, folder := range account.MailFolders() {
+			go runEmailIdleLoop(account, folder)
 		}
-		// delete the message
-		seqset := new(imap.SeqSet)
-		seqset.AddNum(msg.SeqNum)
-
-		flags := []any{imap.DeletedFlag}
-		if err := conn.Store(seqset, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
-			return nil, fmt.Errorf("error deleting message: %v", err)
+		return
+	}
+	for {
+		if _, err := checkMailAccount(account); err != nil {
+			log.Printf("Error checking email of %v: %v", account.DisplayName(), err)
 		}
-		// expunge the mailbox
-		if err := conn.Expunge(nil); err != nil {
-			return nil, fmt.Errorf("error expunging mailbox: %v", err)
+		if !account.sleep(account.checkInterval()) {
+			return
 		}
+	}
+}
 
+// waitForMailAccount connects to the account and lists its mailboxes, retrying with
+// an increasing delay until it works. Errors are shown in the status of every folder.
+func waitForMailAccount(account *MailAccount) {
+	backoff := mailMinBackoff
+	for {
+		err := listMailAccountMailboxes(account)
+		if err == nil {
+			return
+		}
+		log.Printf("Error setting up the email connection to %v: %v, retrying in %v", account.DisplayName(), err, backoff)
+		for _, folder := range account.MailFolders() {
+			account.recordCheck(folder, nil, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > mailMaxBackoff {
+			backoff = mailMaxBackoff
+		}
 	}
-	log.Printf("Done checking email")
-	return stats, nil
+}
 
+// listMailAccountMailboxes checks the configuration of an account by logging the mailboxes it has
+func listMailAccountMailboxes(account *MailAccount) error {
+	log.Printf("Checking email configuration of %v & listing mailboxes...", account.DisplayName())
+	conn, err := dialMailSource(account)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	mailboxes, err := conn.ListMailboxes()
+	if err != nil {
+		return fmt.Errorf("error listing mailboxes: %v", err)
+	}
+	log.Printf("Mailboxes of %v:", account.DisplayName())
+	for _, m := range mailboxes {
+		log.Println("* " + m)
+	}
+	return nil
 }
 
-func runEmailCheckerLoop() {
-	func() {
+var ErrIdleNotSupported = errors.New("the mail server doesn't support IDLE")
+
+// the mailbox is checked at least this often in IDLE mode, in case a notification got lost
+const idleCheckInterval = 20 * time.Minute
+
+// delays between reconnection attempts, they double after every failure
+var (
+	mailMinBackoff = 5 * time.Second
+	mailMaxBackoff = 5 * time.Minute
+)
 
-		emailCheckMutex.Lock()
-		defer emailCheckMutex.Unlock()
-		log.Printf("Checking email configuration & listing mailboxes...")
-		conn, err := setupEmailConn()
+// watchMailbox keeps a connection in IDLE and checks the folder every time the
+// server reports a change. It returns when the connection breaks.
+func watchMailbox(account *MailAccount, folder string) error {
+	conn, err := dialMailSource(account)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	supported, err := conn.SupportsIdle()
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return ErrIdleNotSupported
+	}
+	if _, err := conn.SelectMailbox(folder); err != nil {
+		return fmt.Errorf("error selecting %v: %v", folder, err)
+	}
+	log.Printf("Waiting for new e-mails of %v in %v", account.DisplayName(), folder)
+	for {
+		// checking uses a separate connection, this one only waits
+		stats, err := checkMailFolder(account, folder)
+		account.recordCheck(folder, stats, err)
 		if err != nil {
-			log.Fatalf("Error setting up first email connection: %v", err)
-		}
-		defer conn.Logout()
-		// list mailboxes
-		mailboxes := make(chan *imap.MailboxInfo, 10)
-		done := make(chan error, 1)
-		go func() {
-			done <- conn.List("", "*", mailboxes)
-		}()
-
-		log.Println("Mailboxes:")
-		for m := range mailboxes {
-			log.Println("* " + m.Name)
-		}
-	}()
-	sleepDuration, _ := time.ParseDuration(config.EmailCheckInterval)
+			log.Printf("Error checking email of %v in %v: %v", account.DisplayName(), folder, err)
+		}
+		if err := conn.WaitForNewMail(idleCheckInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// runEmailIdleLoop runs watchMailbox, reconnecting with an increasing delay when the
+// connection breaks. If the server doesn't support IDLE the folder is checked every
+// check interval instead.
+func runEmailIdleLoop(account *MailAccount, folder string) {
+	backoff := mailMinBackoff
 	for {
-		_, err := doCheckEmail()
+		started := time.Now()
+		err := watchMailbox(account, folder)
+		if errors.Is(err, ErrIdleNotSupported) {
+			log.Printf("%v: %v, checking every %v instead", account.DisplayName(), err, account.checkInterval())
+			account.setIdle(false)
+			break
+		}
+		// the connection worked for a while, so this is a new problem
+		if time.Since(started) > mailMaxBackoff {
+			backoff = mailMinBackoff
+		}
+		log.Printf("Error waiting for new e-mails of %v in %v: %v, reconnecting in %v", account.DisplayName(), folder, err, backoff)
+		if !account.sleep(backoff) {
+			return
+		}
+		backoff *= 2
+		if backoff > mailMaxBackoff {
+			backoff = mailMaxBackoff
+		}
+	}
+	for {
+		stats, err := checkMailFolder(account, folder)
+		account.recordCheck(folder, stats, err)
 		if err != nil {
-			log.Printf("Error checking email: %v", err)
+			log.Printf("Error checking email of %v in %v: %v", account.DisplayName(), folder, err)
+		}
+		if !account.sleep(account.checkInterval()) {
+			return
 		}
-		time.Sleep(sleepDuration)
 	}
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+type testAttachment struct {
+	FileName string
+	MimeType string
+	Content  []byte
+}
+
+// testEmail builds a multipart e-mail with the given attachments, like a mail client sends it
+func testEmail(from string, subject string, attachments ...testAttachment) []byte {
+	boundary := "test-boundary"
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "From: %v\r\nTo: invoices@example.com\r\nSubject: %v\r\nMessage-ID: <%v@example.com>\r\n", from, subject, strings.ReplaceAll(subject, " ", "-"))
+	fmt.Fprintf(b, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%v\r\n\r\n", boundary)
+	fmt.Fprintf(b, "--%v\r\nContent-Type: text/plain\r\n\r\nPlease find the invoice attached.\r\n", boundary)
+	for _, a := range attachments {
+		fmt.Fprintf(b, "--%v\r\nContent-Type: %v; name=%q\r\nContent-Disposition: attachment; filename=%q\r\nContent-Transfer-Encoding: base64\r\n\r\n", boundary, a.MimeType, a.FileName, a.FileName)
+		b.WriteString(base64.StdEncoding.EncodeToString(a.Content))
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(b, "--%v--\r\n", boundary)
+	return []byte(b.String())
+}
+
+// useMemoryMailSource makes every mail account connect to a new MemoryMailSource
+func useMemoryMailSource(t *testing.T) *MemoryMailSource {
+	t.Helper()
+	source := NewMemoryMailSource()
+	previous := dialMailSource
+	dialMailSource = source.Dial()
+	t.Cleanup(func() { dialMailSource = previous })
+	return source
+}
+
+func countInvoices(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(&Invoice{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestCheckMailFolderHandlesNewMessagesOnce(t *testing.T) {
+	setupTestBot(t)
+	source := useMemoryMailSource(t)
+	config.EmailProcessedAction = EmailActionMove
+	config.EmailFailedAction = EmailActionMove
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993"}
+
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice for March", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	source.AddMessage("INBOX", testEmail("newsletter@acme.example", "No attachments"))
+	stats, err := checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the text parts are counted too
+	if stats.EmailsChecked != 2 || stats.Attachments != 3 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if count := countInvoices(t); count != 1 {
+		t.Fatalf("expected one invoice, got %v", count)
+	}
+	invoice := &Invoice{}
+	if err := db.Preload("Source").First(invoice).Error; err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Source.Sender != "billing@acme.example" || invoice.Source.Subject != "Invoice for March" {
+		t.Fatalf("unexpected invoice: %+v %+v", invoice, invoice.Source)
+	}
+	if len(source.Messages("INBOX")) != 0 || len(source.Messages("Processed")) != 2 {
+		t.Fatalf("expected the messages to be moved to Processed, INBOX has %v", len(source.Messages("INBOX")))
+	}
+
+	// only the message which arrived since the previous check is handled
+	source.AddMessage("INBOX", testEmail("other@acme.example", "Another one"))
+	stats, err = checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.EmailsChecked != 1 {
+		t.Fatalf("expected one new message, got %+v", stats)
+	}
+	state, err := findMailboxState("test", "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastUid != 3 {
+		t.Fatalf("expected the last UID to be 3, got %v", state.LastUid)
+	}
+}
+
+func TestCheckMailFolderDeletesAndFlagsMessages(t *testing.T) {
+	setupTestBot(t)
+	source := useMemoryMailSource(t)
+	config.EmailProcessedAction = EmailActionDelete
+	config.EmailFailedAction = EmailActionFlag
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993"}
+
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	// without a sender the message can't be handled
+	source.AddMessage("INBOX", []byte("Subject: broken\r\nContent-Type: text/plain\r\n\r\nhello\r\n"))
+	stats, err := checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.EmailsChecked != 2 || stats.Failed != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	remaining := source.Messages("INBOX")
+	if len(remaining) != 1 || !bytes.Contains(remaining[0], []byte("Subject: broken")) {
+		t.Fatalf("expected only the broken message to be left, got %v messages", len(remaining))
+	}
+	flags := source.Flags("INBOX", 2)
+	if len(flags) != 1 || flags[0] != imap.FlaggedFlag {
+		t.Fatalf("expected the broken message to be flagged, got %v", flags)
+	}
+}
+
+func TestCheckMailFolderAfterUidValidityChange(t *testing.T) {
+	setupTestBot(t)
+	source := useMemoryMailSource(t)
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993"}
+
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "First"))
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Second"))
+	if _, err := checkMailFolder(account, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	source.RenumberMailbox("INBOX")
+	stats, err := checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.EmailsChecked != 2 {
+		t.Fatalf("expected every message to be checked again, got %+v", stats)
+	}
+}
+
+// handleTestEmail passes a single e-mail to handleEmailMessage the way checkMailFolder fetches it
+func handleTestEmail(t *testing.T, raw []byte) {
+	t.Helper()
+	source := NewMemoryMailSource()
+	source.AddMessage("INBOX", raw)
+	source.SelectMailbox("INBOX")
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(1)
+	messages, err := source.UidFetch(uidset, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822, imap.FetchEnvelope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handleEmailMessage(messages[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleEmailMessageUnpacksZipAttachments(t *testing.T) {
+	setupTestBot(t)
+
+	archive := &bytes.Buffer{}
+	w := zip.NewWriter(archive)
+	for name, contents := range map[string][]byte{"faktura.pdf": readTestdata(t, "invoice_simple.pdf"), "readme.txt": []byte("not an invoice")} {
+		f, err := w.Create("invoices/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(contents)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	handleTestEmail(t, testEmail("billing@acme.example", "Invoices", testAttachment{"invoices.zip", "application/zip", archive.Bytes()}))
+	invoice := &Invoice{}
+	if err := db.First(invoice).Error; err != nil {
+		t.Fatal(err)
+	}
+	if invoice.FileName != "faktura.pdf" {
+		t.Fatalf("unexpected invoice: %+v", invoice)
+	}
+	if count := countInvoices(t); count != 1 {
+		t.Fatalf("expected only the PDF to be stored, got %v invoices", count)
+	}
+}
+
+func TestHandleEmailMessageStoresKsefAndImageAttachments(t *testing.T) {
+	setupTestBot(t)
+	scan := []byte("\xff\xd8\xff\xe0 scanned invoice")
+
+	handleTestEmail(t, testEmail("billing@acme.example", "Invoices",
+		testAttachment{"faktura.xml", "application/xml", readTestdata(t, "invoice_ksef.xml")},
+		testAttachment{"scan.jpg", "image/jpeg", scan},
+	))
+	if count := countInvoices(t); count != 2 {
+		t.Fatalf("expected the XML and the JPEG to be stored, got %v invoices", count)
+	}
+	xmlInvoice := &Invoice{}
+	if err := db.Where("file_name = ?", "faktura.xml").First(&xmlInvoice).Error; err != nil {
+		t.Fatal(err)
+	}
+	if xmlInvoice.InvoiceNumber != "FV/2023/03/17" || xmlInvoice.GrossAmount == nil || *xmlInvoice.GrossAmount != 133854 {
+		t.Errorf("unexpected XML invoice metadata: %+v", xmlInvoice)
+	}
+	image := &Invoice{}
+	if err := db.Where("file_name = ?", "scan.jpg").First(&image).Error; err != nil {
+		t.Fatal(err)
+	}
+	stored, err := readBlob(image.Sha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, scan) {
+		t.Error("expected the stored image to match the attachment")
+	}
+}
+
+func TestHandleEmailMessageSkipsInlineImages(t *testing.T) {
+	setupTestBot(t)
+	raw := testEmail("billing@acme.example", "Invoice",
+		testAttachment{"logo.png", "image/png", []byte("\x89PNG company logo")},
+		testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")},
+	)
+	// signature logos are embedded in the message body
+	raw = bytes.Replace(raw, []byte(`Content-Disposition: attachment; filename="logo.png"`), []byte(`Content-Disposition: inline; filename="logo.png"`), 1)
+
+	handleTestEmail(t, raw)
+	invoice := &Invoice{}
+	if err := db.First(&invoice).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count := countInvoices(t); count != 1 || invoice.FileName != "faktura.pdf" {
+		t.Errorf("expected only the PDF to be stored, got %v invoices, first %v", count, invoice.FileName)
+	}
+}
+
+func TestCheckMailFolderMovesInvoicesWhichCouldNotBeStored(t *testing.T) {
+	recorder := setupTestBot(t)
+	source := useMemoryMailSource(t)
+	config.EmailProcessedAction = EmailActionMove
+	config.EmailFailedAction = EmailActionMove
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993"}
+	pressButton("/notifications yes")
+	// a file in place of the blob directory makes storing the invoice fail
+	if err := os.WriteFile(filepath.Join(config.StorageDir, "blobs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	stats, err := checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed != 1 || len(source.Messages("Failed")) != 1 || len(source.Messages("Processed")) != 0 {
+		t.Fatalf("expected the message to be moved to Failed, stats: %+v", stats)
+	}
+	if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, "error storing invoice contents") {
+		t.Fatalf("the chats weren't told about the error: %q", msg.Text)
+	}
+
+	// an invoice which is already stored isn't a failure
+	if err := os.Remove(filepath.Join(config.StorageDir, "blobs")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	}
+	stats, err = checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed != 0 || len(source.Messages("Processed")) != 2 {
+		t.Fatalf("expected both messages to be processed, stats: %+v", stats)
+	}
+}
+
+func TestWaitForMailAccountRetries(t *testing.T) {
+	setupTestBot(t)
+	source := NewMemoryMailSource()
+	previousMin, previousMax, previousDial := mailMinBackoff, mailMaxBackoff, dialMailSource
+	t.Cleanup(func() { mailMinBackoff, mailMaxBackoff, dialMailSource = previousMin, previousMax, previousDial })
+	mailMinBackoff, mailMaxBackoff = time.Millisecond, 5*time.Millisecond
+	attempts := 0
+	dialMailSource = func(*MailAccount) (MailSource, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return source, nil
+	}
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993"}
+
+	done := make(chan struct{})
+	go func() {
+		waitForMailAccount(account)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForMailAccount didn't return after the server came back")
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %v", attempts)
+	}
+	if summary := account.StatusSummary(); !strings.Contains(summary, "INBOX last checked") || !strings.Contains(summary, "error: connection refused") {
+		t.Fatalf("the error isn't in the status: %q", summary)
+	}
+}
+
+func TestMailAccountStatusPerFolder(t *testing.T) {
+	setupTestBot(t)
+	source := useMemoryMailSource(t)
+	source.AddMessage("INBOX", testEmail("newsletter@acme.example", "No attachments"))
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993", Folders: []string{"INBOX", "Invoices", "Archive"}}
+	if summary := account.StatusSummary(); !strings.HasSuffix(summary, "INBOX not checked yet; Invoices not checked yet; Archive not checked yet") {
+		t.Fatalf("unexpected status: %q", summary)
+	}
+
+	if _, err := checkMailAccount(account); err == nil {
+		t.Fatal("expected the folders which don't exist to fail")
+	}
+	// like the IDLE loop of one folder does, without touching the others
+	account.recordCheck("Archive", &EmailCheckStats{}, nil)
+	summary := account.StatusSummary()
+	for _, want := range []string{
+		"INBOX last checked",
+		"checked 1 emails",
+		"Invoices last checked",
+		"error: error selecting Invoices: no such mailbox: Invoices",
+		"Archive last checked",
+		"checked 0 emails",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("status %q doesn't contain %q", summary, want)
+		}
+	}
+}
+
+// envelopelessMailSource returns the messages without their envelopes, like a
+// server which ignores the ENVELOPE fetch item
+type envelopelessMailSource struct {
+	*MemoryMailSource
+}
+
+func (s envelopelessMailSource) UidFetch(uidset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	messages, err := s.MemoryMailSource.UidFetch(uidset, items)
+	for _, msg := range messages {
+		msg.Envelope = nil
+	}
+	return messages, err
+}
+
+func TestCheckMailFolderWithoutEnvelope(t *testing.T) {
+	setupTestBot(t)
+	source := envelopelessMailSource{NewMemoryMailSource()}
+	previous := dialMailSource
+	dialMailSource = func(*MailAccount) (MailSource, error) { return source, nil }
+	t.Cleanup(func() { dialMailSource = previous })
+	config.EmailFailedAction = EmailActionFlag
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993"}
+
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice"))
+	stats, err := checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.EmailsChecked != 1 || stats.Failed != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// startEmailIdleLoop runs runEmailIdleLoop until the test ends
+func startEmailIdleLoop(t *testing.T, source *MemoryMailSource, account *MailAccount) {
+	t.Helper()
+	account.stop = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runEmailIdleLoop(account, "INBOX")
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(account.stop)
+		source.Disconnect()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("runEmailIdleLoop didn't stop")
+		}
+	})
+}
+
+// waitForInvoices waits until the background checks store the expected number of invoices
+func waitForInvoices(t *testing.T, count int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for countInvoices(t) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v invoices, got %v", count, countInvoices(t))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunEmailIdleLoopChecksOnNewMail(t *testing.T) {
+	setupTestBot(t)
+	source := useMemoryMailSource(t)
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993", Idle: true}
+	account.setIdle(true)
+
+	startEmailIdleLoop(t, source, account)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(account.StatusSummary(), "INBOX last checked") {
+		if time.Now().After(deadline) {
+			t.Fatal("the mailbox wasn't checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// only IDLE can notice the new message now, the checks are minutes apart otherwise
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	waitForInvoices(t, 1)
+	if summary := account.StatusSummary(); !strings.HasPrefix(summary, "test (IDLE): INBOX last checked") {
+		t.Errorf("unexpected status: %q", summary)
+	}
+}
+
+func TestRunEmailIdleLoopFallsBackToPolling(t *testing.T) {
+	setupTestBot(t)
+	source := useMemoryMailSource(t)
+	source.NoIdle = true
+	account := &MailAccount{Name: "test", ImapAddress: "localhost:993", Idle: true, CheckInterval: "10ms"}
+	account.setIdle(true)
+
+	startEmailIdleLoop(t, source, account)
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Invoice", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	waitForInvoices(t, 1)
+	if summary := account.StatusSummary(); !strings.HasPrefix(summary, "test (checked every 10ms): INBOX last checked") {
+		t.Errorf("expected the account to be polled, got status %q", summary)
+	}
+	// later messages are found by polling too
+	source.AddMessage("INBOX", testEmail("billing@acme.example", "Another invoice", testAttachment{"faktura2.pdf", "application/pdf", readTestdata(t, "invoice_cid.pdf")}))
+	waitForInvoices(t, 2)
+}
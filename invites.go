@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// how long an invite code can be redeemed
+const inviteCodeValidity = 48 * time.Hour
+
+// username of the bot, used to build t.me invite links
+var botUserName string
+
+var ErrInvalidInviteCode = errors.New("this invite code is invalid, expired or already used")
+
+// InviteCode is a single-use code which authorizes whoever redeems it with the given role
+type InviteCode struct {
+	gorm.Model
+	Code      string `gorm:"uniqueIndex"`
+	Role      string
+	CreatedBy int64
+	ExpiresAt time.Time
+	UsedBy    *int64
+	UsedAt    *time.Time
+}
+
+func createInviteCode(role string, createdBy int64) (*InviteCode, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	invite := &InviteCode{
+		Code:      hex.EncodeToString(buf),
+		Role:      role,
+		CreatedBy: createdBy,
+		ExpiresAt: time.Now().Add(inviteCodeValidity),
+	}
+	if err := db.Create(&invite).Error; err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// inviteLink returns the deep link which sends /start <code> to the bot
+func inviteLink(code string) string {
+	if botUserName == "" {
+		return "/start " + code
+	}
+	return fmt.Sprintf("https://t.me/%v?start=%v", botUserName, code)
+}
+
+// redeemInviteCode marks the code as used and authorizes the user with its role
+func redeemInviteCode(code string, telegramID int64, userName string) (*AuthorizedUser, error) {
+	user := &AuthorizedUser{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&AuthorizedUser{}).Where("telegram_id = ?", telegramID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return fmt.Errorf("user %v is already authorized", telegramID)
+		}
+		invite := &InviteCode{}
+		if err := tx.Where("code = ? AND used_at IS NULL AND expires_at > ?", code, time.Now()).First(&invite).Error; err != nil {
+			return ErrInvalidInviteCode
+		}
+		now := time.Now()
+		// the condition on used_at guards against the code being redeemed twice concurrently
+		result := tx.Model(&InviteCode{}).Where("id = ? AND used_at IS NULL", invite.ID).Updates(map[string]any{"used_by": telegramID, "used_at": &now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrInvalidInviteCode
+		}
+		user = &AuthorizedUser{
+			TelegramID: telegramID,
+			UserName:   userName,
+			Role:       invite.Role,
+			InvitedBy:  invite.CreatedBy,
+		}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
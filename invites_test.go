@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestInviteCodeIsSingleUse(t *testing.T) {
+	recorder := setupTestBot(t)
+	invite, err := createInviteCode(RoleUploader, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newcomer := &tgbotapi.User{ID: 43, UserName: "newcomer"}
+	sendCommandAs(newcomer, "/start "+invite.Code)
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "Welcome! You are now authorized as uploader." {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+	user := &AuthorizedUser{}
+	if err := db.Where("telegram_id = ?", newcomer.ID).First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleUploader || user.InvitedBy != testUserID {
+		t.Errorf("unexpected user: %+v", user)
+	}
+
+	if _, err := redeemInviteCode(invite.Code, 44, "another"); !errors.Is(err, ErrInvalidInviteCode) {
+		t.Errorf("expected the used code to be rejected, got %v", err)
+	}
+	var count int64
+	db.Model(&AuthorizedUser{}).Where("telegram_id = ?", 44).Count(&count)
+	if count != 0 {
+		t.Error("expected the second user to stay unauthorized")
+	}
+}
+
+func TestExpiredInviteCode(t *testing.T) {
+	setupTestBot(t)
+	invite, err := createInviteCode(RoleViewer, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&invite).Update("expires_at", time.Now().Add(-time.Minute))
+
+	if _, err := redeemInviteCode(invite.Code, 43, "late"); !errors.Is(err, ErrInvalidInviteCode) {
+		t.Errorf("expected the expired code to be rejected, got %v", err)
+	}
+	if _, err := redeemInviteCode("nonexistent", 43, "late"); !errors.Is(err, ErrInvalidInviteCode) {
+		t.Errorf("expected an unknown code to be rejected, got %v", err)
+	}
+}
+
+func TestInviteCodeForAuthorizedUser(t *testing.T) {
+	setupTestBot(t)
+	invite, err := createInviteCode(RoleViewer, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := redeemInviteCode(invite.Code, testUserID, "tester"); err == nil || !strings.Contains(err.Error(), "already authorized") {
+		t.Errorf("expected an already authorized user to be rejected, got %v", err)
+	}
+	user := &AuthorizedUser{}
+	db.Where("telegram_id = ?", testUserID).First(&user)
+	if user.Role != RoleAdmin {
+		t.Errorf("expected the admin to keep their role, got %v", user.Role)
+	}
+	// the invite is still usable by someone else
+	if _, err := redeemInviteCode(invite.Code, 43, "newcomer"); err != nil {
+		t.Errorf("expected the invite to stay unused, got %v", err)
+	}
+}
+
+func TestAuthorizeRefusedOnceUsersExist(t *testing.T) {
+	recorder := setupTestBot(t)
+	config.TelegramToken = "bot-token"
+
+	stranger := &tgbotapi.User{ID: 43, UserName: "stranger"}
+	sendCommandAs(stranger, "/authorize bot-token")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "The bot already has users, ask an admin for an invite link." {
+		t.Errorf("unexpected reply: %q", msg.Text)
+	}
+	var count int64
+	db.Model(&AuthorizedUser{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected only the existing admin, got %v users", count)
+	}
+
+	// with no users the bot token bootstraps the first admin
+	db.Unscoped().Where("1 = 1").Delete(&AuthorizedUser{})
+	sendCommandAs(stranger, "/authorize bot-token")
+	user := &AuthorizedUser{}
+	if err := db.Where("telegram_id = ?", stranger.ID).First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleAdmin {
+		t.Errorf("expected the first user to be an admin, got %v", user.Role)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// how long the bot waits for the new name or file of an invoice
+const pendingInvoiceActionTimeout = 10 * time.Minute
+
+// pendingInvoiceAction is a rename or replace waiting for the user to send
+// the new name or file and then to confirm the change
+type pendingInvoiceAction struct {
+	Action    string
+	InvoiceID uint
+	FileName  string
+	Contents  []byte
+	ExpiresAt time.Time
+}
+
+// hasInput tells whether the new name or file was received and the change only needs a confirmation
+func (a *pendingInvoiceAction) hasInput() bool {
+	return a.FileName != "" || a.Contents != nil
+}
+
+type pendingInvoiceActionKey struct {
+	ChatID int64
+	UserID int64
+}
+
+var pendingInvoiceActions = map[pendingInvoiceActionKey]*pendingInvoiceAction{}
+var pendingInvoiceActionsMutex sync.Mutex
+
+func setPendingInvoiceAction(chatID int64, userID int64, action *pendingInvoiceAction) {
+	pendingInvoiceActionsMutex.Lock()
+	defer pendingInvoiceActionsMutex.Unlock()
+	key := pendingInvoiceActionKey{ChatID: chatID, UserID: userID}
+	if action == nil {
+		delete(pendingInvoiceActions, key)
+		return
+	}
+	action.ExpiresAt = time.Now().Add(pendingInvoiceActionTimeout)
+	pendingInvoiceActions[key] = action
+}
+
+// takePendingInvoiceAction removes and returns the pending action of the user in the
+// chat, unless matches returns false for it. Expired actions are dropped.
+func takePendingInvoiceAction(chatID int64, userID int64, matches func(action *pendingInvoiceAction) bool) *pendingInvoiceAction {
+	pendingInvoiceActionsMutex.Lock()
+	defer pendingInvoiceActionsMutex.Unlock()
+	key := pendingInvoiceActionKey{ChatID: chatID, UserID: userID}
+	action := pendingInvoiceActions[key]
+	if action == nil {
+		return nil
+	}
+	if time.Now().After(action.ExpiresAt) {
+		delete(pendingInvoiceActions, key)
+		return nil
+	}
+	if !matches(action) {
+		return nil
+	}
+	delete(pendingInvoiceActions, key)
+	return action
+}
+
+func deleteInvoice(invoice *Invoice, actor string) error {
+	if err := db.Delete(&invoice).Error; err != nil {
+		return err
+	}
+	recordAuditEvent(actor, AuditInvoiceDeleted, invoice.ID, invoice.FileName)
+	return nil
+}
+
+func renameInvoice(invoice *Invoice, name string, actor string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name: %q", name)
+	}
+	previousName := invoice.FileName
+	if err := db.Model(&invoice).Update("file_name", name).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&InvoiceSearchText{}).Where("invoice_id = ?", invoice.ID).Update("file_name", name).Error; err != nil {
+		log.Printf("error indexing invoice #%v: %v", invoice.ID, err)
+	}
+	recordAuditEvent(actor, AuditInvoiceRenamed, invoice.ID, fmt.Sprintf("from %v to %v", previousName, name))
+	return nil
+}
+
+func moveInvoice(invoice *Invoice, year int, month int, actor string) error {
+	previousPeriod := invoice.BillingPeriod()
+	invoice.BillingYear = year
+	invoice.BillingMonth = month
+	if err := db.Save(&invoice).Error; err != nil {
+		return err
+	}
+	recordAuditEvent(actor, AuditInvoiceMoved, invoice.ID, fmt.Sprintf("from %v to %v", previousPeriod, invoice.BillingPeriod()))
+	return nil
+}
+
+// replaceInvoiceContents swaps the file of an invoice, keeping its name and billing month
+func replaceInvoiceContents(invoice *Invoice, contents []byte, actor string) error {
+	sha := fmt.Sprintf("%x", sha256.Sum256(contents))
+	if sha == invoice.Sha256 {
+		return fmt.Errorf("the new file is identical to the current one")
+	}
+	var existing int64
+	if err := db.Model(&Invoice{}).Where("sha256 = ?", sha).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrInvoiceExists
+	}
+	if _, err := writeBlob(contents); err != nil {
+		return fmt.Errorf("error storing invoice contents: %v", err)
+	}
+	previousSha := invoice.Sha256
+	invoice.Sha256 = sha
+	text, meta := readInvoiceContents(invoice.FileName, contents)
+	invoice.SetMetadata(meta)
+	invoice.TextSha256 = normalizedTextSha256(text)
+	if err := db.Save(&invoice).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&InvoiceSearchText{}).Where("invoice_id = ?", invoice.ID).Update("text", text).Error; err != nil {
+		log.Printf("error indexing invoice #%v: %v", invoice.ID, err)
+	}
+	recordAuditEvent(actor, AuditInvoiceReplaced, invoice.ID, fmt.Sprintf("sha256 %v replaced with %v", previousSha, sha))
+	return nil
+}
+
+// handleInvoiceCommand implements /invoice, every change has to be confirmed with a second tap:
+//
+//	/invoice <id>                           shows the actions for an invoice
+//	/invoice <id> delete [confirm]          deletes the invoice
+//	/invoice <id> rename [confirm]          asks for a new file name and renames the invoice
+//	/invoice <id> move [YYYY-MM [confirm]]  moves the invoice to another billing month
+//	/invoice <id> replace [confirm]         asks for a new file and replaces the contents
+//	/invoice <id> cancel                    cancels a pending rename or replace
+func handleInvoiceCommand(chatID int64, messageID int, args string, user *AuthorizedUser) {
+	parts := strings.Fields(args)
+	if len(parts) == 0 {
+		sendError(chatID, fmt.Errorf("usage: /invoice <id> [delete | rename | move | replace]"))
+		return
+	}
+	invoiceID, err := strconv.Atoi(strings.TrimPrefix(parts[0], "#"))
+	if err != nil {
+		sendError(chatID, fmt.Errorf("invalid invoice id: %v", parts[0]))
+		return
+	}
+	invoice := &Invoice{}
+	if err := db.Preload("Source").First(&invoice, invoiceID).Error; err != nil {
+		sendError(chatID, fmt.Errorf("invoice #%v not found", invoiceID))
+		return
+	}
+	confirmed := len(parts) > 2 && parts[len(parts)-1] == "confirm"
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	prefix := fmt.Sprintf("/invoice %v ", invoice.ID)
+	confirmButtons := func(confirmText string, confirmData string) [][]MessageButton {
+		return [][]MessageButton{{
+			{Text: confirmText, Data: confirmData},
+			{Text: "Cancel", Data: prefix + "cancel"},
+		}}
+	}
+
+	switch action {
+	case "":
+		text := fmt.Sprintf("Invoice #%v %v, billed in %v", invoice.ID, invoice.FileName, invoice.BillingPeriod())
+		if source := invoice.Source.Describe(); source != "" {
+			text += "\n" + source
+			if invoice.Source.Subject != "" {
+				text += ", subject: " + invoice.Source.Subject
+			}
+		}
+		if summary := invoice.MetadataSummary(); summary != "" {
+			text += "\n" + summary
+		}
+		messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             text,
+			ReplyToMessageID: messageID,
+			Buttons: [][]MessageButton{
+				{{Text: "🗑 Delete", Data: prefix + "delete"}, {Text: "✏️ Rename", Data: prefix + "rename"}},
+				{{Text: "📅 Move", Data: prefix + "move"}, {Text: "🔄 Replace file", Data: prefix + "replace"}},
+			},
+		})
+	case "cancel":
+		setPendingInvoiceAction(chatID, user.TelegramID, nil)
+		replyText(chatID, messageID, "Cancelled")
+	case "delete":
+		if !confirmed {
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             fmt.Sprintf("Delete invoice #%v %v from %v?", invoice.ID, invoice.FileName, invoice.BillingPeriod()),
+				ReplyToMessageID: messageID,
+				Buttons:          confirmButtons("🗑 Delete", prefix+"delete confirm"),
+			})
+			return
+		}
+		if err := deleteInvoice(invoice, user.AuditActor()); err != nil {
+			sendError(chatID, err)
+			return
+		}
+		replyText(chatID, messageID, fmt.Sprintf("Invoice #%v %v deleted", invoice.ID, invoice.FileName))
+	case "move":
+		if len(parts) == 2 {
+			current := time.Date(invoice.BillingYear, time.Month(invoice.BillingMonth), 1, 0, 0, 0, 0, time.UTC)
+			monthButtons := []MessageButton{}
+			for _, offset := range []int{-2, -1, 1, 2} {
+				month := current.AddDate(0, offset, 0).Format("2006-01")
+				monthButtons = append(monthButtons, MessageButton{Text: month, Data: prefix + "move " + month})
+			}
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             fmt.Sprintf("Move invoice #%v from %v to which month? For other months use /invoice %v move YYYY-MM.", invoice.ID, invoice.BillingPeriod(), invoice.ID),
+				ReplyToMessageID: messageID,
+				Buttons:          [][]MessageButton{monthButtons},
+			})
+			return
+		}
+		year, month, err := parseYearMonth(parts[2])
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		if !confirmed {
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             fmt.Sprintf("Move invoice #%v %v from %v to %v?", invoice.ID, invoice.FileName, invoice.BillingPeriod(), parts[2]),
+				ReplyToMessageID: messageID,
+				Buttons:          confirmButtons("📅 Move", prefix+"move "+parts[2]+" confirm"),
+			})
+			return
+		}
+		previousPeriod := invoice.BillingPeriod()
+		if err := moveInvoice(invoice, year, month, user.AuditActor()); err != nil {
+			sendError(chatID, err)
+			return
+		}
+		reply := fmt.Sprintf("Invoice %v moved from %v to %v", invoice.FileName, previousPeriod, invoice.BillingPeriod())
+		if warning := lateInvoiceWarning(invoice); warning != "" {
+			reply += "\n\n" + warning
+		}
+		replyText(chatID, messageID, reply)
+	case "rename", "replace":
+		if !confirmed {
+			setPendingInvoiceAction(chatID, user.TelegramID, &pendingInvoiceAction{Action: action, InvoiceID: invoice.ID})
+			prompt := fmt.Sprintf("Send the new file name for invoice #%v %v.", invoice.ID, invoice.FileName)
+			if action == "replace" {
+				prompt = fmt.Sprintf("Send the new file for invoice #%v %v.", invoice.ID, invoice.FileName)
+			}
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             prompt,
+				ReplyToMessageID: messageID,
+				Buttons:          [][]MessageButton{{{Text: "Cancel", Data: prefix + "cancel"}}},
+			})
+			return
+		}
+		pending := takePendingInvoiceAction(chatID, user.TelegramID, func(pending *pendingInvoiceAction) bool {
+			return pending.Action == action && pending.InvoiceID == invoice.ID && pending.hasInput()
+		})
+		if pending == nil {
+			sendError(chatID, fmt.Errorf("nothing to confirm, start again with /invoice %v %v", invoice.ID, action))
+			return
+		}
+		if action == "rename" {
+			previousName := invoice.FileName
+			if err := renameInvoice(invoice, pending.FileName, user.AuditActor()); err != nil {
+				sendError(chatID, err)
+				return
+			}
+			replyText(chatID, messageID, fmt.Sprintf("Invoice #%v renamed from %v to %v", invoice.ID, previousName, invoice.FileName))
+			return
+		}
+		if err := replaceInvoiceContents(invoice, pending.Contents, user.AuditActor()); err != nil {
+			sendError(chatID, err)
+			return
+		}
+		reply := fmt.Sprintf("Contents of invoice #%v %v replaced", invoice.ID, invoice.FileName)
+		if summary := invoice.MetadataSummary(); summary != "" {
+			reply += "\n" + summary
+		}
+		replyText(chatID, messageID, reply)
+	default:
+		sendError(chatID, fmt.Errorf("unknown invoice action: %v", action))
+	}
+}
+
+// handlePendingInvoiceAction takes the new name or file of a pending rename or replace
+// from a message and asks for the confirmation. Only the next message of the user in the
+// chat answers the prompt, anything else than the expected name or file cancels it. It
+// returns false when the message wasn't an answer.
+func handlePendingInvoiceAction(message *tgbotapi.Message, command string, user *AuthorizedUser) bool {
+	chatID := message.Chat.ID
+	pending := takePendingInvoiceAction(chatID, user.TelegramID, func(pending *pendingInvoiceAction) bool {
+		return !pending.hasInput()
+	})
+	if pending == nil {
+		return false
+	}
+	prefix := fmt.Sprintf("/invoice %v ", pending.InvoiceID)
+	var question string
+	switch {
+	case command == "" && pending.Action == "rename" && strings.TrimSpace(message.Text) != "":
+		pending.FileName = strings.TrimSpace(message.Text)
+		question = fmt.Sprintf("Rename invoice #%v to %v?", pending.InvoiceID, pending.FileName)
+	case command == "" && pending.Action == "replace" && message.Document != nil:
+		data, err := messenger.DownloadFile(message.Document.FileID)
+		if err != nil {
+			sendError(chatID, err)
+			return true
+		}
+		pending.Contents = data
+		question = fmt.Sprintf("Replace the file of invoice #%v with %v?", pending.InvoiceID, message.Document.FileName)
+	default:
+		replyText(chatID, message.MessageID, fmt.Sprintf("Cancelled the %v of invoice #%v", pending.Action, pending.InvoiceID))
+		return false
+	}
+	setPendingInvoiceAction(chatID, user.TelegramID, pending)
+	messenger.SendText(OutgoingMessage{
+		ChatID:           chatID,
+		Text:             question,
+		ReplyToMessageID: message.MessageID,
+		Buttons: [][]MessageButton{{
+			{Text: "✅ Confirm", Data: prefix + pending.Action + " confirm"},
+			{Text: "Cancel", Data: prefix + "cancel"},
+		}},
+	})
+	return true
+}
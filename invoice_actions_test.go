@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// sendText delivers a plain text message from the user to the chat
+func sendText(user *tgbotapi.User, chatID int64, text string) {
+	nextTestMessageID++
+	HandleMessage(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: nextTestMessageID,
+		From:      user,
+		Chat:      &tgbotapi.Chat{ID: chatID},
+		Text:      text,
+	}})
+}
+
+func invoiceFileName(t *testing.T, id uint) string {
+	t.Helper()
+	invoice := &Invoice{}
+	if err := db.First(invoice, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return invoice.FileName
+}
+
+func TestRenameInvoice(t *testing.T) {
+	recorder := setupTestBot(t)
+	uploadDocument(recorder, "faktura.pdf", readTestdata(t, "invoice_simple.pdf"))
+
+	pressButton("/invoice 1 rename")
+	if msg := lastMessage(t, recorder, testChatID); !hasButton(msg, "/invoice 1 cancel") {
+		t.Fatalf("expected a cancel button, got %q %+v", msg.Text, msg.Buttons)
+	}
+	sendText(testUser(), testChatID, "acme.pdf")
+	msg := lastMessage(t, recorder, testChatID)
+	if msg.Text != "Rename invoice #1 to acme.pdf?" || !hasButton(msg, "/invoice 1 rename confirm") || !hasButton(msg, "/invoice 1 cancel") {
+		t.Fatalf("unexpected confirmation: %q %+v", msg.Text, msg.Buttons)
+	}
+	// text sent while the confirmation is shown isn't taken as another name
+	sendText(testUser(), testChatID, "hello")
+	pressButton("/invoice 1 rename confirm")
+	if name := invoiceFileName(t, 1); name != "acme.pdf" {
+		t.Fatalf("invoice not renamed: %v", name)
+	}
+	// the confirmation works only once
+	pressButton("/invoice 1 rename confirm")
+	if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, "nothing to confirm") {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+}
+
+func TestRenameInvoiceTakesOnlyTheNextMessageOfTheUser(t *testing.T) {
+	recorder := setupTestBot(t)
+	other := &tgbotapi.User{ID: 43, UserName: "other"}
+	if err := db.Create(&AuthorizedUser{TelegramID: other.ID, UserName: other.UserName, Role: RoleAdmin}).Error; err != nil {
+		t.Fatal(err)
+	}
+	uploadDocument(recorder, "faktura.pdf", readTestdata(t, "invoice_simple.pdf"))
+
+	pressButton("/invoice 1 rename")
+	// other users and other chats don't answer the prompt
+	sendText(other, testChatID, "other.pdf")
+	sendText(testUser(), testChatID+1, "elsewhere.pdf")
+	if msgs := recorder.MessagesTo(testChatID); strings.Contains(msgs[len(msgs)-1].Text, "Rename invoice") {
+		t.Fatalf("a message of another user was taken as the new name: %q", msgs[len(msgs)-1].Text)
+	}
+	// a command ends the wait and is handled as usual
+	sendCommand("/invoices")
+	msgs := recorder.MessagesTo(testChatID)
+	if len(msgs) < 2 || msgs[len(msgs)-2].Text != "Cancelled the rename of invoice #1" || !strings.HasPrefix(msgs[len(msgs)-1].Text, "Provide a year and a month") {
+		t.Fatalf("unexpected replies: %+v", msgs)
+	}
+	sendText(testUser(), testChatID, "late.pdf")
+	pressButton("/invoice 1 rename confirm")
+	if name := invoiceFileName(t, 1); name != "faktura.pdf" {
+		t.Fatalf("invoice renamed after the wait was cancelled: %v", name)
+	}
+}
+
+func TestCancelInvoiceRename(t *testing.T) {
+	recorder := setupTestBot(t)
+	uploadDocument(recorder, "faktura.pdf", readTestdata(t, "invoice_simple.pdf"))
+
+	pressButton("/invoice 1 rename")
+	pressButton("/invoice 1 cancel")
+	sendText(testUser(), testChatID, "acme.pdf")
+	if msg := lastMessage(t, recorder, testChatID); strings.Contains(msg.Text, "Rename invoice") {
+		t.Fatalf("the cancelled rename took the message: %q", msg.Text)
+	}
+	pressButton("/invoice 1 rename confirm")
+	if name := invoiceFileName(t, 1); name != "faktura.pdf" {
+		t.Fatalf("invoice renamed after cancelling: %v", name)
+	}
+}
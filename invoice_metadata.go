@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InvoiceMetadata is what could be read from the text of an invoice.
+// Amounts are in hundredths of the currency unit, nil when not found.
+type InvoiceMetadata struct {
+	Number      string
+	SellerNIP   string
+	IssueDate   *time.Time
+	NetAmount   *int64
+	VatAmount   *int64
+	GrossAmount *int64
+	Currency    string
+}
+
+var (
+	invoiceNumberRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)(?:numer|nr)\s+faktury[\s.:]*([\p{L}0-9][\p{L}0-9/\-_.]*)`),
+		regexp.MustCompile(`(?i)faktura(?:\s+vat)?(?:\s+korygująca)?[\s.:]+(?:nr|numer|no)?[\s.:]*([\p{L}0-9][\p{L}0-9/\-_.]*)`),
+		regexp.MustCompile(`(?i)invoice\s+(?:no|number|nr)[\s.:]*([\p{L}0-9][\p{L}0-9/\-_.]*)`),
+	}
+	sellerMarkerRegex = regexp.MustCompile(`(?i)sprzedawca|sprzedający|wystawca|seller|vendor`)
+	nipRegex          = regexp.MustCompile(`(?i)(?:NIP|VAT\s*ID|tax\s*id)[\s.:]*(?:PL)?\s*(\d{3}[- ]?\d{3}[- ]?\d{2}[- ]?\d{2}|\d{3}[- ]?\d{2}[- ]?\d{2}[- ]?\d{3})`)
+	issueDateRegex    = regexp.MustCompile(`(?i)(?:data\s+wystawienia|data\s+faktury|issue\s+date|date\s+of\s+issue|invoice\s+date)[\s.:]*(` + datePattern + `)`)
+	datePattern       = `\d{4}-\d{2}-\d{2}|\d{1,2}[./-]\d{1,2}[./-]\d{4}|\d{1,2}\s+\p{L}+\s+\d{4}`
+	textDateRegex     = regexp.MustCompile(`^(\d{1,2})\s+(\p{L}+)\s+(\d{4})$`)
+	dateRegex         = regexp.MustCompile(datePattern)
+	amountPattern     = `-?(?:\d{1,3}(?:[ \x{00a0}.,]\d{3})+|\d+)[.,]\d{2}`
+	amountRegex       = regexp.MustCompile(amountPattern)
+	grossAmountRegex  = regexp.MustCompile(`(?i)(?:do\s+zapłaty|do\s+zaplaty|kwota\s+brutto|wartość\s+brutto|razem\s+brutto|total\s+due|amount\s+due|\btotal)[\s.:]*(?:\p{L}{3}\s*)?(` + amountPattern + `)`)
+	netAmountRegex    = regexp.MustCompile(`(?i)(?:wartość\s+netto|wartosc\s+netto|razem\s+netto|kwota\s+netto|net\s+amount|\bsubtotal)[\s.:]*(?:\p{L}{3}\s*)?(` + amountPattern + `)`)
+	vatAmountRegex    = regexp.MustCompile(`(?i)(?:kwota\s+vat|podatek\s+vat|wartość\s+vat|razem\s+vat|vat\s+amount)[\s.:]*(?:\p{L}{3}\s*)?(` + amountPattern + `)`)
+	totalsLineRegex   = regexp.MustCompile(`(?i)^\s*(?:razem|suma|ogółem|ogolem|total)\b`)
+	percentRegex      = regexp.MustCompile(`\d+(?:[.,]\d+)?\s*%`)
+	currencyRegex     = regexp.MustCompile(`\b(PLN|EUR|USD|GBP|CHF|CZK)\b|(zł)`)
+)
+
+// extractInvoiceMetadata looks for the usual fields of a (mostly Polish) invoice in its text
+func extractInvoiceMetadata(text string) InvoiceMetadata {
+	meta := InvoiceMetadata{}
+	for _, r := range invoiceNumberRegexes {
+		if m := r.FindStringSubmatch(text); m != nil && strings.ContainsAny(m[1], "0123456789") {
+			meta.Number = strings.TrimRight(m[1], ".-_/")
+			break
+		}
+	}
+
+	// the seller is usually listed first, prefer the first valid NIP after the seller header
+	sellerText := text
+	if loc := sellerMarkerRegex.FindStringIndex(text); loc != nil {
+		sellerText = text[loc[0]:]
+	}
+	for _, candidates := range []string{sellerText, text} {
+		for _, m := range nipRegex.FindAllStringSubmatch(candidates, -1) {
+			nip := strings.NewReplacer("-", "", " ", "").Replace(m[1])
+			if isValidNIP(nip) {
+				meta.SellerNIP = nip
+				break
+			}
+		}
+		if meta.SellerNIP != "" {
+			break
+		}
+	}
+
+	if m := issueDateRegex.FindStringSubmatch(text); m != nil {
+		meta.IssueDate = parseInvoiceDate(m[1])
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		// dates and VAT rates look like amounts, drop them first
+		line = dateRegex.ReplaceAllString(line, " ")
+		line = percentRegex.ReplaceAllString(line, " ")
+		if meta.GrossAmount == nil {
+			if m := grossAmountRegex.FindStringSubmatch(line); m != nil {
+				meta.GrossAmount = parseAmount(m[1])
+			}
+		}
+		if meta.NetAmount == nil {
+			if m := netAmountRegex.FindStringSubmatch(line); m != nil {
+				meta.NetAmount = parseAmount(m[1])
+			}
+		}
+		if meta.VatAmount == nil {
+			if m := vatAmountRegex.FindStringSubmatch(line); m != nil {
+				meta.VatAmount = parseAmount(m[1])
+			}
+		}
+		// a totals row of the items table: net, VAT, gross
+		if totalsLineRegex.MatchString(line) {
+			amounts := amountRegex.FindAllString(line, -1)
+			if len(amounts) >= 3 {
+				net, vat, gross := parseAmount(amounts[len(amounts)-3]), parseAmount(amounts[len(amounts)-2]), parseAmount(amounts[len(amounts)-1])
+				if net != nil && vat != nil && gross != nil && *net+*vat == *gross {
+					meta.NetAmount, meta.VatAmount = net, vat
+					if meta.GrossAmount == nil {
+						meta.GrossAmount = gross
+					}
+				}
+			}
+		}
+	}
+
+	if m := currencyRegex.FindStringSubmatch(text); m != nil {
+		meta.Currency = m[1]
+		if m[2] != "" {
+			meta.Currency = "PLN"
+		}
+	}
+	return meta
+}
+
+// isValidNIP checks the length and the check digit of a Polish tax ID
+func isValidNIP(nip string) bool {
+	if len(nip) != 10 {
+		return false
+	}
+	weights := []int{6, 5, 7, 2, 3, 4, 5, 6, 7}
+	sum := 0
+	for i, w := range weights {
+		if nip[i] < '0' || nip[i] > '9' {
+			return false
+		}
+		sum += int(nip[i]-'0') * w
+	}
+	return sum%11 == int(nip[9]-'0')
+}
+
+// polishMonths maps Polish month names, both the nominative and the genitive
+// form used in dates ("5 kwietnia 2023"), to month numbers
+var polishMonths = map[string]time.Month{
+	"styczeń": time.January, "stycznia": time.January,
+	"luty": time.February, "lutego": time.February,
+	"marzec": time.March, "marca": time.March,
+	"kwiecień": time.April, "kwietnia": time.April,
+	"maj": time.May, "maja": time.May,
+	"czerwiec": time.June, "czerwca": time.June,
+	"lipiec": time.July, "lipca": time.July,
+	"sierpień": time.August, "sierpnia": time.August,
+	"wrzesień": time.September, "września": time.September,
+	"październik": time.October, "października": time.October,
+	"listopad": time.November, "listopada": time.November,
+	"grudzień": time.December, "grudnia": time.December,
+}
+
+func parseInvoiceDate(s string) *time.Time {
+	if m := textDateRegex.FindStringSubmatch(s); m != nil {
+		month, ok := polishMonths[strings.ToLower(m[2])]
+		if !ok {
+			return nil
+		}
+		day, _ := strconv.Atoi(m[1])
+		year, _ := strconv.Atoi(m[3])
+		if day < 1 || day > 31 {
+			return nil
+		}
+		t := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+		return &t
+	}
+	s = strings.NewReplacer("/", ".", "-", ".").Replace(s)
+	for _, layout := range []string{"2006.01.02", "2.1.2006"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// parseAmount parses amounts like "1 234,56", "1.234,56" or "1,234.56" into hundredths
+func parseAmount(s string) *int64 {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	// the last separator is the decimal one, everything else groups thousands
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+	v, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return nil
+	}
+	if negative {
+		v = -v
+	}
+	return &v
+}
+
+func formatAmount(v int64, currency string) string {
+	sign := ""
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	s := fmt.Sprintf("%v%d.%02d", sign, v/100, v%100)
+	if currency != "" {
+		s += " " + currency
+	}
+	return s
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsValidNIP(t *testing.T) {
+	tests := map[string]bool{
+		"5261040828":  true,
+		"1234563218":  true,
+		"5261040829":  false,
+		"526104082":   false,
+		"52610408280": false,
+		"526104082a":  false,
+		"":            false,
+		// the check digit would have to be 10
+		"9000000000": false,
+	}
+	for nip, want := range tests {
+		if got := isValidNIP(nip); got != want {
+			t.Errorf("isValidNIP(%q) = %v, want %v", nip, got, want)
+		}
+	}
+}
+
+func TestParseInvoiceDate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"2023-03-31", "2023-03-31"},
+		{"31.03.2023", "2023-03-31"},
+		{"1/4/2023", "2023-04-01"},
+		{"5-4-2023", "2023-04-05"},
+		{"5 kwietnia 2023", "2023-04-05"},
+		{"12 Października 2022", "2022-10-12"},
+		{"1 maj 2023", "2023-05-01"},
+		{"5 april 2023", ""},
+		{"32 marca 2023", ""},
+		{"2023-13-01", ""},
+		{"31.02.2023", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := parseInvoiceDate(tt.in)
+		gotStr := ""
+		if got != nil {
+			gotStr = got.Format("2006-01-02")
+		}
+		if gotStr != tt.want {
+			t.Errorf("parseInvoiceDate(%q) = %q, want %q", tt.in, gotStr, tt.want)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1230,00", 123000, true},
+		{"1 230,00", 123000, true},
+		{"1 230,00", 123000, true},
+		{"1.234,56", 123456, true},
+		{"1,234.56", 123456, true},
+		{"0.99", 99, true},
+		{"-15,00", -1500, true},
+		{"", 0, false},
+		{"99999999999999999999,00", 0, false},
+	}
+	for _, tt := range tests {
+		got := parseAmount(tt.in)
+		if (got != nil) != tt.ok || (got != nil && *got != tt.want) {
+			t.Errorf("parseAmount(%q) = %v, want %v (ok: %v)", tt.in, got, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		v        int64
+		currency string
+		want     string
+	}{
+		{123000, "PLN", "1230.00 PLN"},
+		{5, "", "0.05"},
+		{-1500, "EUR", "-15.00 EUR"},
+	}
+	for _, tt := range tests {
+		if got := formatAmount(tt.v, tt.currency); got != tt.want {
+			t.Errorf("formatAmount(%v, %q) = %q, want %q", tt.v, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestExtractInvoiceMetadata(t *testing.T) {
+	date := func(s string) *time.Time {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.Local)
+		return &d
+	}
+	tests := []struct {
+		name  string
+		text  string
+		want  InvoiceMetadata
+		net   int64
+		vat   int64
+		gross int64
+	}{
+		{
+			name: "totals row",
+			text: "Faktura VAT nr FV/12/03/2023\nData wystawienia: 2023-03-31\nSprzedawca: Nabywca:\nACME Sp. z o.o. Klient SA\nNIP: 526-104-08-28 NIP: 123-456-32-18\n1 Usluga 1 1 000,00 1 000,00 23% 230,00 1 230,00\nRazem: 1 000,00 230,00 1 230,00\nDo zaplaty: 1 230,00 PLN",
+			want: InvoiceMetadata{Number: "FV/12/03/2023", SellerNIP: "5261040828", IssueDate: date("2023-03-31"), Currency: "PLN"},
+			net:  100000, vat: 23000, gross: 123000,
+		},
+		{
+			name: "labelled amounts",
+			text: "Faktura nr 2023/04/0007\nData wystawienia: 5 kwietnia 2023\nSprzedawca\nNIP PL5261040828\nNabywca\nNIP 1234563218\nWartość netto: 2.500,00 zł\nKwota VAT: 575,00 zł\nDo zapłaty: 3.075,00 zł",
+			want: InvoiceMetadata{Number: "2023/04/0007", SellerNIP: "5261040828", IssueDate: date("2023-04-05"), Currency: "PLN"},
+			net:  250000, vat: 57500, gross: 307500,
+		},
+		{
+			name: "english invoice",
+			text: "Invoice number: INV-2023-001\nIssue date: 02.05.2023\nSeller\nVAT ID: PL 123-45-63-218\nSubtotal: EUR 100.00\nVAT amount: EUR 23.00\nTotal due: EUR 123.00",
+			want: InvoiceMetadata{Number: "INV-2023-001", SellerNIP: "1234563218", IssueDate: date("2023-05-02"), Currency: "EUR"},
+			net:  10000, vat: 2300, gross: 12300,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := extractInvoiceMetadata(tt.text)
+			if meta.Number != tt.want.Number || meta.SellerNIP != tt.want.SellerNIP || meta.Currency != tt.want.Currency {
+				t.Errorf("got number %q, NIP %q, currency %q, want %q, %q, %q", meta.Number, meta.SellerNIP, meta.Currency, tt.want.Number, tt.want.SellerNIP, tt.want.Currency)
+			}
+			if meta.IssueDate == nil || !meta.IssueDate.Equal(*tt.want.IssueDate) {
+				t.Errorf("issue date = %v, want %v", meta.IssueDate, tt.want.IssueDate)
+			}
+			for _, amount := range []struct {
+				name string
+				got  *int64
+				want int64
+			}{{"net", meta.NetAmount, tt.net}, {"VAT", meta.VatAmount, tt.vat}, {"gross", meta.GrossAmount, tt.gross}} {
+				if amount.got == nil || *amount.got != amount.want {
+					t.Errorf("%v amount = %v, want %v", amount.name, amount.got, amount.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractInvoiceMetadataWithoutFields(t *testing.T) {
+	meta := extractInvoiceMetadata("Dzień dobry,\nw załączniku przesyłam dokumenty.\nNIP: 5261040829")
+	if meta.Number != "" || meta.SellerNIP != "" || meta.IssueDate != nil || meta.GrossAmount != nil {
+		t.Fatalf("expected nothing to be found, got %+v", meta)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	SourceTelegram = "telegram"
+	SourceEmail    = "email"
+	SourceApi      = "api"
+)
+
+// InvoiceSource records where an invoice came from
+type InvoiceSource struct {
+	ID        uint `gorm:"primarykey"`
+	InvoiceID uint `gorm:"uniqueIndex"`
+	Channel   string
+	// e-mail address for e-mails, user name for Telegram, token name for the API
+	Sender  string
+	Subject string
+	// Message-ID header of the e-mail
+	MessageID  string
+	Recipients string
+	// the Telegram user who uploaded the invoice
+	UploaderTelegramID int64
+}
+
+func newTelegramInvoiceSource(user *AuthorizedUser) *InvoiceSource {
+	return &InvoiceSource{
+		Channel:            SourceTelegram,
+		Sender:             user.DisplayName(),
+		UploaderTelegramID: user.TelegramID,
+	}
+}
+
+func newEmailInvoiceSource(attachment AttachmentToHandle) *InvoiceSource {
+	return &InvoiceSource{
+		Channel:    SourceEmail,
+		Sender:     attachment.SenderEmail,
+		Subject:    attachment.Subject,
+		MessageID:  attachment.MessageID,
+		Recipients: strings.Join(append(append([]string{}, attachment.To...), attachment.CC...), ", "),
+	}
+}
+
+func newApiInvoiceSource(token *ApiToken) *InvoiceSource {
+	return &InvoiceSource{
+		Channel: SourceApi,
+		Sender:  token.Name,
+	}
+}
+
+// AuditActor describes who added the invoice, in the same form as the other audit events
+func (s *InvoiceSource) AuditActor() string {
+	if s.Channel == SourceTelegram {
+		return fmt.Sprintf("telegram %v (%v)", s.Sender, s.UploaderTelegramID)
+	}
+	return s.Channel + " " + s.Sender
+}
+
+// Describe returns a short description for listings, e.g. "e-mail from biuro@example.com"
+func (s *InvoiceSource) Describe() string {
+	if s == nil {
+		return ""
+	}
+	switch s.Channel {
+	case SourceTelegram:
+		return "uploaded by " + s.Sender
+	case SourceEmail:
+		return "e-mail from " + s.Sender
+	case SourceApi:
+		return "API client " + s.Sender
+	}
+	return s.Channel
+}
@@ -1,24 +1,119 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"log"
+	"time"
 )
 
-func processIncomingInvoice(filename string, contents []byte) error {
+var ErrInvoiceExists = errors.New("invoice with this sha256 already exists")
+
+// lateInvoiceWarning returns a warning when the invoice is billed in a month
+// which has already been sent to accounting, or an empty string otherwise
+func lateInvoiceWarning(invoice *Invoice) string {
+	var count int64
+	err := db.Model(&NotifiedChat{}).
+		Where("last_acknowledged_year > ? OR (last_acknowledged_year = ? AND last_acknowledged_month >= ?)",
+			invoice.BillingYear, invoice.BillingYear, invoice.BillingMonth).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("error checking if %v is acknowledged: %v", invoice.BillingPeriod(), err)
+		return ""
+	}
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("⚠️ Late invoice: %v has already been sent to accounting, this invoice has to be sent separately.", invoice.BillingPeriod())
+}
+
+func findMonthInvoices(year int, month int) ([]Invoice, error) {
+	var invoices []Invoice
+	err := db.Preload("Source").Where("billing_year = ? AND billing_month = ?", year, month).Find(&invoices).Error
+	return invoices, err
+}
+
+// parseYearMonth parses a YYYY-MM month
+func parseYearMonth(s string) (year int, month int, err error) {
+	t, err := time.Parse("2006-01", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid month %q, expected YYYY-MM", s)
+	}
+	return t.Year(), int(t.Month()), nil
+}
+
+// readInvoiceContents extracts the text and metadata of an invoice. For KSeF XML
+// invoices the text is a rendered summary. Both are empty for images and other formats.
+func readInvoiceContents(filename string, contents []byte) (string, InvoiceMetadata) {
+	if isXmlInvoice(contents) {
+		text, meta, err := readKsefInvoice(contents)
+		if err != nil {
+			log.Printf("error reading XML invoice %v: %v", filename, err)
+		}
+		return text, meta
+	}
+	if !bytes.HasPrefix(contents, []byte("%PDF")) {
+		return "", InvoiceMetadata{}
+	}
+	text, err := extractPdfText(contents)
+	if err != nil {
+		log.Printf("error extracting text from %v: %v", filename, err)
+		return "", InvoiceMetadata{}
+	}
+	return text, extractInvoiceMetadata(text)
+}
+
+// processIncomingInvoice stores a new invoice, extracting whatever metadata can be read from it.
+// source describes where the invoice came from and is stored along with it.
+func processIncomingInvoice(filename string, contents []byte, source *InvoiceSource) (*Invoice, error) {
 	sha265 := fmt.Sprintf("%x", sha256.Sum256(contents))
+	now := time.Now()
 	invoice := &Invoice{
-		FileName: filename,
-		Contents: contents,
-		Sha256:   sha265,
+		FileName:     filename,
+		Sha256:       sha265,
+		BillingYear:  now.Year(),
+		BillingMonth: int(now.Month()),
 	}
 	if db.Where("sha256 = ?", sha265).First(&invoice).Error == nil {
 
-		return fmt.Errorf("invoice with this sha256 already exists")
+		return nil, ErrInvoiceExists
+	}
+	if _, err := writeBlob(contents); err != nil {
+		return nil, fmt.Errorf("error storing invoice contents: %v", err)
 	}
+	text, meta := readInvoiceContents(filename, contents)
+	invoice.SetMetadata(meta)
+	invoice.TextSha256 = normalizedTextSha256(text)
+	// different bytes, but possibly the same invoice sent again
+	duplicate, err := findLikelyDuplicate(invoice)
+	if err != nil {
+		return nil, err
+	}
+	if duplicate != nil {
+		invoice.DuplicateOfID = &duplicate.ID
+	}
+	// file the invoice under the month it was issued in, not the month it arrived in
+	if invoice.IssueDate != nil {
+		invoice.BillingYear = invoice.IssueDate.Year()
+		invoice.BillingMonth = int(invoice.IssueDate.Month())
+	}
+	invoice.Source = source
 	if err := db.Create(&invoice).Error; err != nil {
 
-		return err
+		return nil, err
+	}
+	searchText := &InvoiceSearchText{
+		InvoiceID: invoice.ID,
+		FileName:  filename,
+		Subject:   source.Subject,
+		Sender:    source.Sender,
+		Text:      text,
+	}
+	if err := indexInvoice(searchText); err != nil {
+		log.Printf("error indexing invoice #%v: %v", invoice.ID, err)
 	}
-	return nil
+	recordAuditEvent(source.AuditActor(), AuditInvoiceUploaded, invoice.ID, fmt.Sprintf("%v billed in %v", filename, invoice.BillingPeriod()))
+	return invoice, nil
 }
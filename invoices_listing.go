@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// number of invoices per page of the /invoices listing
+const invoicesPageSize = 10
+
+// invoicesPageCount returns the number of listing pages needed for count invoices
+func invoicesPageCount(count int) int {
+	return (count + invoicesPageSize - 1) / invoicesPageSize
+}
+
+// invoiceDownloadButton sends the file of the invoice when pressed
+func invoiceDownloadButton(invoice Invoice) MessageButton {
+	name := invoice.FileName
+	if len([]rune(name)) > 30 {
+		name = string([]rune(name)[:29]) + "…"
+	}
+	return MessageButton{Text: fmt.Sprintf("📄 #%v %v", invoice.ID, name), Data: fmt.Sprintf("/download %v", invoice.ID)}
+}
+
+// renderInvoicesPage builds one page of the listing of a month. Every invoice gets
+// a button sending its file and, if canManage, one opening its management menu.
+// The totals are always computed for the whole month.
+func renderInvoicesPage(month string, invoices []Invoice, page int, canManage bool) (string, [][]MessageButton) {
+	pages := invoicesPageCount(len(invoices))
+	if page < 1 {
+		page = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * invoicesPageSize
+	end := start + invoicesPageSize
+	if end > len(invoices) {
+		end = len(invoices)
+	}
+
+	invoicesStr := ""
+	buttons := [][]MessageButton{}
+	for _, invoice := range invoices[start:end] {
+		date := invoice.CreatedAt.Format("2006-01-02")
+		invoicesStr += fmt.Sprintf("#%v %v: %v", invoice.ID, date, invoice.FileName)
+		if invoice.InvoiceNumber != "" {
+			invoicesStr += " [" + invoice.InvoiceNumber + "]"
+		}
+		if invoice.GrossAmount != nil {
+			invoicesStr += " (" + formatAmount(*invoice.GrossAmount, invoice.Currency) + ")"
+		}
+		if source := invoice.Source.Describe(); source != "" {
+			invoicesStr += ", " + source
+		}
+		if invoice.DuplicateOfID != nil {
+			invoicesStr += fmt.Sprintf(" ⚠️ possible duplicate of #%v", *invoice.DuplicateOfID)
+		}
+		invoicesStr += "\n"
+
+		row := []MessageButton{invoiceDownloadButton(invoice)}
+		if canManage {
+			row = append(row, MessageButton{Text: "✏️", Data: fmt.Sprintf("/invoice %v", invoice.ID)})
+		}
+		buttons = append(buttons, row)
+	}
+
+	grossTotals := map[string]int64{}
+	for _, invoice := range invoices {
+		if invoice.GrossAmount != nil {
+			grossTotals[invoice.Currency] += *invoice.GrossAmount
+		}
+	}
+	currencies := []string{}
+	for currency := range grossTotals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		invoicesStr += fmt.Sprintf("Total gross: %v\n", formatAmount(grossTotals[currency], currency))
+	}
+
+	title := fmt.Sprintf("Invoices for %v:\n", month)
+	if pages > 1 {
+		title = fmt.Sprintf("Invoices for %v (page %v/%v, %v invoices):\n", month, page, pages, len(invoices))
+		navigation := []MessageButton{}
+		if page > 1 {
+			navigation = append(navigation, MessageButton{Text: "« Previous", Data: fmt.Sprintf("/invoices %v page %v", month, page-1)})
+		}
+		if page < pages {
+			navigation = append(navigation, MessageButton{Text: "Next »", Data: fmt.Sprintf("/invoices %v page %v", month, page+1)})
+		}
+		buttons = append(buttons, navigation)
+	}
+	return title + invoicesStr, buttons
+}
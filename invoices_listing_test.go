@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func testListingInvoices(count int) []Invoice {
+	invoices := []Invoice{}
+	for i := 1; i <= count; i++ {
+		invoices = append(invoices, Invoice{
+			Model:    gorm.Model{ID: uint(i), CreatedAt: time.Date(2023, 3, i, 12, 0, 0, 0, time.UTC)},
+			FileName: fmt.Sprintf("faktura_%v.pdf", i),
+		})
+	}
+	return invoices
+}
+
+func TestRenderInvoicesPage(t *testing.T) {
+	invoices := testListingInvoices(2)
+	gross := int64(123000)
+	invoices[0].InvoiceNumber = "FV/12/03/2023"
+	invoices[0].GrossAmount = &gross
+	invoices[0].Currency = "PLN"
+
+	text, buttons := renderInvoicesPage("2023-03", invoices, 0, true)
+	want := "Invoices for 2023-03:\n" +
+		"#1 2023-03-01: faktura_1.pdf [FV/12/03/2023] (1230.00 PLN)\n" +
+		"#2 2023-03-02: faktura_2.pdf\n" +
+		"Total gross: 1230.00 PLN\n"
+	if text != want {
+		t.Fatalf("got %q, want %q", text, want)
+	}
+	if len(buttons) != 2 || len(buttons[0]) != 2 || buttons[0][0].Data != "/download 1" || buttons[0][1].Data != "/invoice 1" {
+		t.Fatalf("unexpected buttons: %+v", buttons)
+	}
+
+	_, buttons = renderInvoicesPage("2023-03", invoices, 0, false)
+	if len(buttons[0]) != 1 {
+		t.Fatalf("viewers got a management button: %+v", buttons[0])
+	}
+}
+
+func TestRenderInvoicesPagePagination(t *testing.T) {
+	invoices := testListingInvoices(invoicesPageSize*2 + 1)
+	tests := []struct {
+		page       int
+		title      string
+		first      string
+		navigation []string
+	}{
+		{0, "Invoices for 2023-03 (page 1/3, 21 invoices):", "#1 ", []string{"/invoices 2023-03 page 2"}},
+		{2, "Invoices for 2023-03 (page 2/3, 21 invoices):", "#11 ", []string{"/invoices 2023-03 page 1", "/invoices 2023-03 page 3"}},
+		{9, "Invoices for 2023-03 (page 3/3, 21 invoices):", "#21 ", []string{"/invoices 2023-03 page 2"}},
+	}
+	for _, tt := range tests {
+		text, buttons := renderInvoicesPage("2023-03", invoices, tt.page, false)
+		lines := strings.Split(text, "\n")
+		if lines[0] != tt.title || !strings.HasPrefix(lines[1], tt.first) {
+			t.Errorf("page %v: unexpected text %q", tt.page, text)
+		}
+		navigation := []string{}
+		for _, button := range buttons[len(buttons)-1] {
+			navigation = append(navigation, button.Data)
+		}
+		if strings.Join(navigation, ",") != strings.Join(tt.navigation, ",") {
+			t.Errorf("page %v: navigation %v, want %v", tt.page, navigation, tt.navigation)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ksefInvoice is the part of the KSeF structured invoice (FA schema) the bot uses.
+// Element names are matched without namespaces, so FA(1), FA(2) and FA(3) all parse.
+type ksefInvoice struct {
+	XMLName xml.Name   `xml:"Faktura"`
+	Seller  ksefParty  `xml:"Podmiot1"`
+	Buyer   ksefParty  `xml:"Podmiot2"`
+	Fa      ksefFaPart `xml:"Fa"`
+}
+
+type ksefParty struct {
+	NIP  string `xml:"DaneIdentyfikacyjne>NIP"`
+	Name string `xml:"DaneIdentyfikacyjne>Nazwa"`
+}
+
+type ksefFaPart struct {
+	Currency  string `xml:"KodWaluty"`
+	IssueDate string `xml:"P_1"`
+	Number    string `xml:"P_2"`
+	SaleDate  string `xml:"P_6"`
+	Gross     string `xml:"P_15"`
+	Rows      []struct {
+		Name     string `xml:"P_7"`
+		Quantity string `xml:"P_8B"`
+		Unit     string `xml:"P_8A"`
+		Net      string `xml:"P_11"`
+		Rate     string `xml:"P_12"`
+	} `xml:"FaWiersz"`
+	// the per-rate sums P_13_x (net) and P_14_x (VAT)
+	Other []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// VAT rates of the P_13_x net sums
+var ksefRateLabels = map[string]string{
+	"P_13_1":   "23%",
+	"P_13_2":   "8%",
+	"P_13_3":   "5%",
+	"P_13_6_1": "0%",
+	"P_13_7":   "zw",
+}
+
+// isXmlInvoice tells whether the contents look like an XML document
+func isXmlInvoice(contents []byte) bool {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(contents, []byte("\ufeff")))
+	return bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<Faktura"))
+}
+
+// parseXmlAmount parses a decimal like 1230.5 into hundredths
+func parseXmlAmount(s string) *int64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	whole, fraction, _ := strings.Cut(s, ".")
+	fraction = (fraction + "00")[:2]
+	v, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// readKsefInvoice extracts the metadata of a KSeF XML invoice and renders a plain text
+// summary of it, which is what gets searched and shown to people
+func readKsefInvoice(contents []byte) (string, InvoiceMetadata, error) {
+	invoice := &ksefInvoice{}
+	if err := xml.Unmarshal(contents, invoice); err != nil {
+		return "", InvoiceMetadata{}, fmt.Errorf("not a KSeF invoice: %v", err)
+	}
+	fa := invoice.Fa
+	meta := InvoiceMetadata{
+		Number:      strings.TrimSpace(fa.Number),
+		SellerNIP:   strings.TrimSpace(invoice.Seller.NIP),
+		GrossAmount: parseXmlAmount(fa.Gross),
+		Currency:    strings.TrimSpace(fa.Currency),
+	}
+	if issueDate, err := time.Parse("2006-01-02", strings.TrimSpace(fa.IssueDate)); err == nil {
+		meta.IssueDate = &issueDate
+	}
+	// P_13_x are the net sums per VAT rate, P_14_x the VAT, P_14_xW the VAT converted to PLN
+	nets := map[string]int64{}
+	vats := map[string]int64{}
+	for _, element := range fa.Other {
+		name := element.XMLName.Local
+		amount := parseXmlAmount(element.Value)
+		if amount == nil {
+			continue
+		}
+		if strings.HasPrefix(name, "P_13_") {
+			nets[name] = *amount
+		} else if strings.HasPrefix(name, "P_14_") && !strings.HasSuffix(name, "W") {
+			vats[name] = *amount
+		}
+	}
+	sum := func(amounts map[string]int64) *int64 {
+		if len(amounts) == 0 {
+			return nil
+		}
+		var total int64
+		for _, v := range amounts {
+			total += v
+		}
+		return &total
+	}
+	meta.NetAmount = sum(nets)
+	meta.VatAmount = sum(vats)
+
+	lines := []string{fmt.Sprintf("Faktura %v", meta.Number)}
+	if fa.IssueDate != "" {
+		lines = append(lines, "Data wystawienia: "+fa.IssueDate)
+	}
+	if fa.SaleDate != "" {
+		lines = append(lines, "Data sprzedaży: "+fa.SaleDate)
+	}
+	lines = append(lines,
+		fmt.Sprintf("Sprzedawca: %v, NIP %v", strings.TrimSpace(invoice.Seller.Name), meta.SellerNIP),
+		fmt.Sprintf("Nabywca: %v, NIP %v", strings.TrimSpace(invoice.Buyer.Name), strings.TrimSpace(invoice.Buyer.NIP)),
+	)
+	for i, row := range fa.Rows {
+		line := fmt.Sprintf("%v. %v", i+1, strings.TrimSpace(row.Name))
+		if row.Quantity != "" {
+			line += fmt.Sprintf(", %v %v", row.Quantity, row.Unit)
+		}
+		if net := parseXmlAmount(row.Net); net != nil {
+			line += ", netto " + formatAmount(*net, "")
+		}
+		if row.Rate != "" {
+			line += ", VAT " + row.Rate
+			if _, err := strconv.Atoi(row.Rate); err == nil {
+				line += "%"
+			}
+		}
+		lines = append(lines, line)
+	}
+	rates := []string{}
+	for name := range nets {
+		rates = append(rates, name)
+	}
+	sort.Strings(rates)
+	for _, name := range rates {
+		label := name
+		if rate, ok := ksefRateLabels[name]; ok {
+			label = rate
+		}
+		lines = append(lines, fmt.Sprintf("Netto (%v): %v", label, formatAmount(nets[name], meta.Currency)))
+	}
+	if meta.VatAmount != nil {
+		lines = append(lines, "VAT: "+formatAmount(*meta.VatAmount, meta.Currency))
+	}
+	if meta.GrossAmount != nil {
+		lines = append(lines, "Brutto: "+formatAmount(*meta.GrossAmount, meta.Currency))
+	}
+	return strings.Join(lines, "\n"), meta, nil
+}
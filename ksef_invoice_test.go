@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestParseXmlAmount(t *testing.T) {
+	tests := map[string]int64{
+		"1230.50": 123050,
+		"1230.5":  123050,
+		"1230":    123000,
+		" 0.07 ":  7,
+		"-15.20":  -1520,
+		// only two decimal places are kept
+		"1.999": 199,
+	}
+	for in, want := range tests {
+		got := parseXmlAmount(in)
+		if got == nil || *got != want {
+			t.Errorf("parseXmlAmount(%q) = %v, want %v", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "  ", "abc", "12,50"} {
+		if got := parseXmlAmount(in); got != nil {
+			t.Errorf("parseXmlAmount(%q) = %v, want nil", in, *got)
+		}
+	}
+}
+
+func TestReadKsefInvoice(t *testing.T) {
+	contents := readTestdata(t, "invoice_ksef.xml")
+	if !isXmlInvoice(contents) {
+		t.Fatal("expected the fixture to be recognized as XML")
+	}
+	text, meta, err := readKsefInvoice(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Number != "FV/2023/03/17" || meta.SellerNIP != "5261040828" || meta.Currency != "PLN" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	if meta.IssueDate == nil || meta.IssueDate.Format("2006-01-02") != "2023-03-31" {
+		t.Errorf("unexpected issue date: %v", meta.IssueDate)
+	}
+	for name, tt := range map[string]struct {
+		got  *int64
+		want int64
+	}{
+		"net":   {meta.NetAmount, 110050},
+		"vat":   {meta.VatAmount, 23804},
+		"gross": {meta.GrossAmount, 133854},
+	} {
+		if tt.got == nil || *tt.got != tt.want {
+			t.Errorf("%v amount = %v, want %v", name, tt.got, tt.want)
+		}
+	}
+
+	want := `Faktura FV/2023/03/17
+Data wystawienia: 2023-03-31
+Data sprzedaży: 2023-03-30
+Sprzedawca: ACME Sp. z o.o., NIP 5261040828
+Nabywca: Gdański Klub, NIP 1234563218
+1. Hosting, 1 mies., netto 1000.00, VAT 23%
+2. Catering, netto 100.50, VAT 8%
+Netto (23%): 1000.00 PLN
+Netto (8%): 100.50 PLN
+VAT: 238.04 PLN
+Brutto: 1338.54 PLN`
+	if text != want {
+		t.Errorf("unexpected summary:\n%v\nwant:\n%v", text, want)
+	}
+}
+
+func TestReadKsefInvoiceRejectsOtherXml(t *testing.T) {
+	contents := []byte(`<?xml version="1.0"?><Invoice><ID>1</ID></Invoice>`)
+	if !isXmlInvoice(contents) {
+		t.Fatal("expected the document to be recognized as XML")
+	}
+	if _, _, err := readKsefInvoice(contents); err == nil {
+		t.Error("expected an error for a non-KSeF document")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEmailCheckInterval = 10 * time.Minute
+
+// MailAccount is an IMAP account the invoices are delivered to
+type MailAccount struct {
+	// shown in /checkemail and used to store which messages were handled, defaults to the username
+	Name         string `json:"name"`
+	ImapAddress  string `json:"imap_address"`
+	ImapUsername string `json:"imap_username"`
+	ImapPassword string `json:"imap_password"`
+	// password (the default), xoauth2 or oauthbearer, see mail_oauth2.go
+	Auth               string `json:"auth"`
+	OAuth2TokenUrl     string `json:"oauth2_token_url"`
+	OAuth2ClientID     string `json:"oauth2_client_id"`
+	OAuth2ClientSecret string `json:"oauth2_client_secret"`
+	OAuth2Scope        string `json:"oauth2_scope"`
+	// only used until the token endpoint issues a new one, the current one is stored in the database
+	OAuth2RefreshToken string `json:"oauth2_refresh_token"`
+	// the mailboxes which are checked, INBOX by default
+	Folders []string `json:"folders"`
+	// defaults to email_check_interval
+	CheckInterval string `json:"check_interval"`
+	// wait for new mail with IMAP IDLE instead of checking every CheckInterval
+	Idle bool `json:"idle"`
+
+	status mailAccountStatus
+	// closed to stop the loops checking the account, the bot itself never does it
+	stop chan struct{}
+}
+
+// mailAccountStatus describes the latest check of every folder of an account
+type mailAccountStatus struct {
+	// held while the account is being checked
+	checkMutex sync.Mutex
+
+	mu      sync.Mutex
+	idle    bool
+	folders map[string]*mailFolderStatus
+}
+
+// mailFolderStatus describes the latest check of a folder
+type mailFolderStatus struct {
+	lastCheck time.Time
+	lastStats *EmailCheckStats
+	lastError error
+}
+
+var mailAccountsOnce sync.Once
+var configuredMailAccounts []*MailAccount
+
+// mailAccounts returns the configured accounts, the legacy imap_* options are the first one
+func mailAccounts() []*MailAccount {
+	mailAccountsOnce.Do(func() {
+		if config.ImapAddress != "" {
+			configuredMailAccounts = append(configuredMailAccounts, &MailAccount{
+				ImapAddress:  config.ImapAddress,
+				ImapUsername: config.ImapUsername,
+				ImapPassword: config.ImapPassword,
+				Idle:         config.EmailIdle,
+			})
+		}
+		configuredMailAccounts = append(configuredMailAccounts, config.MailAccounts...)
+	})
+	return configuredMailAccounts
+}
+
+func validateMailAccounts() error {
+	names := map[string]bool{}
+	for _, account := range mailAccounts() {
+		if account.ImapAddress == "" {
+			return fmt.Errorf("mail account %q has no imap_address", account.DisplayName())
+		}
+		if names[account.DisplayName()] {
+			return fmt.Errorf("there is more than one mail account named %q", account.DisplayName())
+		}
+		names[account.DisplayName()] = true
+		if err := validateMailAuth(account); err != nil {
+			return err
+		}
+		if account.CheckInterval != "" {
+			if _, err := time.ParseDuration(account.CheckInterval); err != nil {
+				return fmt.Errorf("invalid check_interval of mail account %q: %v", account.DisplayName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *MailAccount) DisplayName() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.ImapUsername
+}
+
+func (a *MailAccount) MailFolders() []string {
+	if len(a.Folders) == 0 {
+		return []string{"INBOX"}
+	}
+	return a.Folders
+}
+
+func (a *MailAccount) checkInterval() time.Duration {
+	interval := a.CheckInterval
+	if interval == "" {
+		interval = config.EmailCheckInterval
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		return defaultEmailCheckInterval
+	}
+	return d
+}
+
+// sleep waits for d, it returns false if the account was stopped in the meantime
+func (a *MailAccount) sleep(d time.Duration) bool {
+	select {
+	case <-a.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (a *MailAccount) setIdle(idle bool) {
+	a.status.mu.Lock()
+	defer a.status.mu.Unlock()
+	a.status.idle = idle
+}
+
+func (a *MailAccount) recordCheck(folder string, stats *EmailCheckStats, err error) {
+	a.status.mu.Lock()
+	defer a.status.mu.Unlock()
+	if a.status.folders == nil {
+		a.status.folders = map[string]*mailFolderStatus{}
+	}
+	a.status.folders[folder] = &mailFolderStatus{lastCheck: time.Now(), lastStats: stats, lastError: err}
+}
+
+// StatusSummary describes how the account is checked and how the latest check of each folder went
+func (a *MailAccount) StatusSummary() string {
+	a.status.mu.Lock()
+	defer a.status.mu.Unlock()
+	mode := fmt.Sprintf("checked every %v", a.checkInterval())
+	if a.status.idle {
+		mode = "IDLE"
+	}
+	folders := []string{}
+	for _, folder := range a.MailFolders() {
+		status := a.status.folders[folder]
+		switch {
+		case status == nil:
+			folders = append(folders, folder+" not checked yet")
+		case status.lastError != nil:
+			folders = append(folders, fmt.Sprintf("%v last checked %v, error: %v", folder, status.lastCheck.Format("2006-01-02 15:04"), status.lastError))
+		default:
+			folders = append(folders, fmt.Sprintf("%v last checked %v, %v", folder, status.lastCheck.Format("2006-01-02 15:04"), status.lastStats))
+		}
+	}
+	return fmt.Sprintf("%v (%v): %v", a.DisplayName(), mode, strings.Join(folders, "; "))
+}
+
+// checkMailAccount checks every folder of an account
+func checkMailAccount(account *MailAccount) (*EmailCheckStats, error) {
+	stats := &EmailCheckStats{}
+	failures := []string{}
+	for _, folder := range account.MailFolders() {
+		folderStats, err := checkMailFolder(account, folder)
+		account.recordCheck(folder, folderStats, err)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", folder, err))
+			continue
+		}
+		stats.Add(folderStats)
+	}
+	var err error
+	if len(failures) > 0 {
+		err = errors.New(strings.Join(failures, "; "))
+	}
+	return stats, err
+}
+
+// doCheckEmail checks every account and returns the status of each one
+func doCheckEmail() []string {
+	statuses := []string{}
+	for _, account := range mailAccounts() {
+		if _, err := checkMailAccount(account); err != nil {
+			log.Printf("Error checking email of %v: %v", account.DisplayName(), err)
+		}
+		statuses = append(statuses, account.StatusSummary())
+	}
+	return statuses
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"gorm.io/gorm"
+)
+
+// how a mail account logs in
+const (
+	MailAuthPassword    = "password"
+	MailAuthXOAuth2     = "xoauth2"
+	MailAuthOAuthBearer = "oauthbearer"
+)
+
+// access tokens this close to expiring are renewed before use
+const oauth2ExpiryMargin = time.Minute
+
+var oauth2HttpClient = &http.Client{Timeout: 30 * time.Second}
+
+// OAuth2Token holds the tokens of a mail account which logs in with OAuth2. The refresh
+// token from the config is only the first one, providers may issue new ones.
+type OAuth2Token struct {
+	gorm.Model
+	// the DisplayName of the MailAccount
+	Account string `gorm:"uniqueIndex"`
+	// the oauth2_refresh_token from the config the tokens were obtained with
+	ConfigRefreshToken string
+	RefreshToken       string
+	AccessToken        string
+	ExpiresAt          time.Time
+}
+
+var oauth2TokenMutex sync.Mutex
+
+func validateMailAuth(account *MailAccount) error {
+	switch account.Auth {
+	case "", MailAuthPassword:
+		return nil
+	case MailAuthXOAuth2, MailAuthOAuthBearer:
+	default:
+		return fmt.Errorf("unknown auth %q of mail account %q, expected password, xoauth2 or oauthbearer", account.Auth, account.DisplayName())
+	}
+	if account.OAuth2TokenUrl == "" || account.OAuth2ClientID == "" || account.OAuth2RefreshToken == "" {
+		return fmt.Errorf("mail account %q needs oauth2_token_url, oauth2_client_id and oauth2_refresh_token", account.DisplayName())
+	}
+	return nil
+}
+
+// oauth2TokenResponse is the response of the token endpoint, RFC 6749 section 5
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refreshOAuth2Token gets a new access token from the token endpoint of the account
+func refreshOAuth2Token(account *MailAccount, token *OAuth2Token) error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+		"client_id":     {account.OAuth2ClientID},
+	}
+	if account.OAuth2ClientSecret != "" {
+		form.Set("client_secret", account.OAuth2ClientSecret)
+	}
+	if account.OAuth2Scope != "" {
+		form.Set("scope", account.OAuth2Scope)
+	}
+	resp, err := oauth2HttpClient.PostForm(account.OAuth2TokenUrl, form)
+	if err != nil {
+		return fmt.Errorf("error requesting access token: %v", err)
+	}
+	defer resp.Body.Close()
+	response := &oauth2TokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("error reading token response (%v): %v", resp.Status, err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("token endpoint returned %v: %v", response.Error, response.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return fmt.Errorf("token endpoint returned %v without an access token", resp.Status)
+	}
+	token.AccessToken = response.AccessToken
+	token.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	if response.RefreshToken != "" {
+		token.RefreshToken = response.RefreshToken
+	}
+	return nil
+}
+
+// oauth2AccessToken returns a valid access token of the account, renewing it when needed.
+// fresh tells whether the token was just issued.
+func oauth2AccessToken(account *MailAccount) (accessToken string, fresh bool, err error) {
+	oauth2TokenMutex.Lock()
+	defer oauth2TokenMutex.Unlock()
+	token := &OAuth2Token{}
+	if err := db.Where("account = ?", account.DisplayName()).Limit(1).Find(token).Error; err != nil {
+		return "", false, err
+	}
+	// a new refresh token in the config replaces whatever was stored
+	if token.ConfigRefreshToken != account.OAuth2RefreshToken {
+		token.Account = account.DisplayName()
+		token.ConfigRefreshToken = account.OAuth2RefreshToken
+		token.RefreshToken = account.OAuth2RefreshToken
+		token.AccessToken = ""
+	}
+	if token.AccessToken != "" && time.Until(token.ExpiresAt) > oauth2ExpiryMargin {
+		return token.AccessToken, false, nil
+	}
+	log.Printf("Renewing the OAuth2 access token of %v", account.DisplayName())
+	if err := refreshOAuth2Token(account, token); err != nil {
+		return "", false, err
+	}
+	if err := db.Save(token).Error; err != nil {
+		return "", false, fmt.Errorf("error saving OAuth2 tokens: %v", err)
+	}
+	return token.AccessToken, true, nil
+}
+
+// forgetOAuth2AccessToken makes the next login renew the access token, e.g. after it was rejected
+func forgetOAuth2AccessToken(account *MailAccount) {
+	oauth2TokenMutex.Lock()
+	defer oauth2TokenMutex.Unlock()
+	err := db.Model(&OAuth2Token{}).Where("account = ?", account.DisplayName()).Update("access_token", "").Error
+	if err != nil {
+		log.Printf("error forgetting the access token of %v: %v", account.DisplayName(), err)
+	}
+}
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism used by Gmail and Microsoft 365
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+// Next gets an error description, the server expects an empty response and then fails
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	log.Printf("XOAUTH2 login of %v failed: %s", c.username, challenge)
+	return []byte{}, nil
+}
+
+func oauth2SaslClient(account *MailAccount, accessToken string) sasl.Client {
+	if account.Auth == MailAuthOAuthBearer {
+		host, portStr, _ := net.SplitHostPort(account.ImapAddress)
+		port, _ := strconv.Atoi(portStr)
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: account.ImapUsername,
+			Token:    accessToken,
+			Host:     host,
+			Port:     port,
+		})
+	}
+	return &xoauth2Client{username: account.ImapUsername, token: accessToken}
+}
+
+// loginMailAccount logs in with the password or the OAuth2 access token of the account
+func loginMailAccount(conn *client.Client, account *MailAccount) error {
+	if account.Auth == "" || account.Auth == MailAuthPassword {
+		return conn.Login(account.ImapUsername, account.ImapPassword)
+	}
+	mechanism := strings.ToUpper(account.Auth)
+	if ok, err := conn.SupportAuth(mechanism); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("the mail server doesn't support %v", mechanism)
+	}
+	accessToken, fresh, err := oauth2AccessToken(account)
+	if err != nil {
+		return err
+	}
+	err = conn.Authenticate(oauth2SaslClient(account, accessToken))
+	if err == nil || fresh {
+		if err != nil {
+			forgetOAuth2AccessToken(account)
+		}
+		return err
+	}
+	// the stored token may have been revoked before it expired, try once more with a new one
+	forgetOAuth2AccessToken(account)
+	if accessToken, _, err = oauth2AccessToken(account); err != nil {
+		return err
+	}
+	if err := conn.Authenticate(oauth2SaslClient(account, accessToken)); err != nil {
+		forgetOAuth2AccessToken(account)
+		return errors.New("OAuth2 login failed: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+)
+
+// testTokenEndpoint is a localhost stand-in for the token endpoint of an OAuth2
+// provider. Every refresh issues a new access token and rotates the refresh token.
+type testTokenEndpoint struct {
+	*httptest.Server
+	mu sync.Mutex
+	// the refresh token the endpoint accepts
+	refreshToken string
+	requests     int
+	accessToken  string
+}
+
+func startTestTokenEndpoint(t *testing.T, refreshToken string) *testTokenEndpoint {
+	t.Helper()
+	e := &testTokenEndpoint{refreshToken: refreshToken}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *testTokenEndpoint) serve(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("grant_type") != "refresh_token" || r.FormValue("client_id") != "bot" || r.FormValue("client_secret") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.FormValue("refresh_token") != e.refreshToken {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "the refresh token was revoked"})
+		return
+	}
+	e.accessToken = fmt.Sprintf("access-%v", e.requests)
+	e.refreshToken = fmt.Sprintf("refresh-%v", e.requests)
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  e.accessToken,
+		"refresh_token": e.refreshToken,
+		"expires_in":    3600,
+	})
+}
+
+// issued returns the latest access token and how many requests the endpoint got
+func (e *testTokenEndpoint) issued() (string, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.accessToken, e.requests
+}
+
+func testOAuth2Account(endpoint *testTokenEndpoint, addr string) *MailAccount {
+	return &MailAccount{
+		Name:               "test",
+		ImapAddress:        addr,
+		ImapUsername:       "username",
+		Auth:               MailAuthXOAuth2,
+		OAuth2TokenUrl:     endpoint.URL,
+		OAuth2ClientID:     "bot",
+		OAuth2ClientSecret: "secret",
+		OAuth2RefreshToken: "refresh-config",
+	}
+}
+
+func storedOAuth2Token(t *testing.T) *OAuth2Token {
+	t.Helper()
+	token := &OAuth2Token{}
+	if err := db.Where("account = ?", "test").First(token).Error; err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOAuth2AccessTokenIsStoredAndRenewed(t *testing.T) {
+	setupTestBot(t)
+	endpoint := startTestTokenEndpoint(t, "refresh-config")
+	account := testOAuth2Account(endpoint, "localhost:993")
+
+	accessToken, fresh, err := oauth2AccessToken(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "access-1" || !fresh {
+		t.Fatalf("got %q (fresh: %v), want a new access-1", accessToken, fresh)
+	}
+	token := storedOAuth2Token(t)
+	if token.AccessToken != "access-1" || token.RefreshToken != "refresh-1" || token.ConfigRefreshToken != "refresh-config" {
+		t.Fatalf("unexpected stored tokens: %+v", token)
+	}
+
+	// a valid token is reused
+	if accessToken, fresh, err = oauth2AccessToken(account); err != nil || accessToken != "access-1" || fresh {
+		t.Fatalf("got %q (fresh: %v, error: %v), want the stored access-1", accessToken, fresh, err)
+	}
+	if _, requests := endpoint.issued(); requests != 1 {
+		t.Fatalf("the token endpoint was asked %v times", requests)
+	}
+
+	// a token about to expire is renewed with the rotated refresh token
+	if err := db.Model(token).Update("expires_at", time.Now().Add(oauth2ExpiryMargin/2)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if accessToken, fresh, err = oauth2AccessToken(account); err != nil || accessToken != "access-2" || !fresh {
+		t.Fatalf("got %q (fresh: %v, error: %v), want a new access-2", accessToken, fresh, err)
+	}
+	if token := storedOAuth2Token(t); token.RefreshToken != "refresh-2" {
+		t.Fatalf("the rotated refresh token wasn't stored: %+v", token)
+	}
+}
+
+func TestOAuth2AccessTokenWithNewConfigRefreshToken(t *testing.T) {
+	setupTestBot(t)
+	endpoint := startTestTokenEndpoint(t, "refresh-config")
+	account := testOAuth2Account(endpoint, "localhost:993")
+	if _, _, err := oauth2AccessToken(account); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old refresh token is revoked and a new one is put in the config
+	endpoint.mu.Lock()
+	endpoint.refreshToken = "refresh-new-config"
+	endpoint.mu.Unlock()
+	account.OAuth2RefreshToken = "refresh-new-config"
+	accessToken, fresh, err := oauth2AccessToken(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "access-2" || !fresh {
+		t.Fatalf("got %q (fresh: %v), want a new access-2", accessToken, fresh)
+	}
+	if token := storedOAuth2Token(t); token.ConfigRefreshToken != "refresh-new-config" {
+		t.Fatalf("unexpected stored tokens: %+v", token)
+	}
+}
+
+func TestRefreshOAuth2TokenErrors(t *testing.T) {
+	setupTestBot(t)
+	endpoint := startTestTokenEndpoint(t, "refresh-config")
+	account := testOAuth2Account(endpoint, "localhost:993")
+
+	err := refreshOAuth2Token(account, &OAuth2Token{RefreshToken: "revoked"})
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant: the refresh token was revoked") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	noToken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"token_type": "Bearer"}`))
+	}))
+	defer noToken.Close()
+	account.OAuth2TokenUrl = noToken.URL
+	if err := refreshOAuth2Token(account, &OAuth2Token{RefreshToken: "refresh-config"}); err == nil || !strings.Contains(err.Error(), "without an access token") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// xoauth2Server accepts the XOAUTH2 logins of "username" with the access token the
+// token endpoint issued last. Like Gmail it answers a rejected token with a JSON
+// challenge and fails after the client's empty response.
+type xoauth2Server struct {
+	conn     server.Conn
+	bkd      backend.Backend
+	endpoint *testTokenEndpoint
+	rejected bool
+}
+
+func (s *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if s.rejected {
+		return nil, true, errors.New("invalid credentials")
+	}
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	accessToken, _ := s.endpoint.issued()
+	if !bytes.Equal(response, []byte("user=username\x01auth=Bearer "+accessToken+"\x01\x01")) || accessToken == "" {
+		s.rejected = true
+		return []byte(`{"status":"401","schemes":"Bearer"}`), false, nil
+	}
+	user, err := s.bkd.Login(s.conn.Info(), "username", "password")
+	if err != nil {
+		return nil, true, err
+	}
+	ctx := s.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
+
+func startTestXOAuth2ImapServer(t *testing.T, endpoint *testTokenEndpoint) string {
+	t.Helper()
+	_, _, addr := startTestImapServer(t, func(srv *server.Server, bkd backend.Backend) {
+		srv.EnableAuth("XOAUTH2", func(conn server.Conn) sasl.Server {
+			return &xoauth2Server{conn: conn, bkd: bkd, endpoint: endpoint}
+		})
+	})
+	return addr
+}
+
+func TestLoginMailAccountWithXOAuth2(t *testing.T) {
+	setupTestBot(t)
+	endpoint := startTestTokenEndpoint(t, "refresh-config")
+	account := testOAuth2Account(endpoint, startTestXOAuth2ImapServer(t, endpoint))
+
+	conn, err := dialImapMailSource(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.SelectMailbox("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// the next login reuses the stored access token
+	conn, err = dialImapMailSource(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, requests := endpoint.issued(); requests != 1 {
+		t.Fatalf("the token endpoint was asked %v times", requests)
+	}
+}
+
+func TestLoginMailAccountRetriesRejectedToken(t *testing.T) {
+	setupTestBot(t)
+	endpoint := startTestTokenEndpoint(t, "refresh-config")
+	account := testOAuth2Account(endpoint, startTestXOAuth2ImapServer(t, endpoint))
+	// a stored token which hasn't expired yet, but which the server no longer accepts
+	err := db.Create(&OAuth2Token{
+		Account:            "test",
+		ConfigRefreshToken: "refresh-config",
+		RefreshToken:       "refresh-config",
+		AccessToken:        "revoked",
+		ExpiresAt:          time.Now().Add(time.Hour),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialImapMailSource(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if token := storedOAuth2Token(t); token.AccessToken != "access-1" || token.RefreshToken != "refresh-1" {
+		t.Fatalf("expected the renewed tokens to be stored, got %+v", token)
+	}
+}
+
+func TestLoginMailAccountWithRejectedFreshToken(t *testing.T) {
+	setupTestBot(t)
+	endpoint := startTestTokenEndpoint(t, "refresh-config")
+	// the server rejects every token
+	_, _, addr := startTestImapServer(t, func(srv *server.Server, _ backend.Backend) {
+		srv.EnableAuth("XOAUTH2", func(conn server.Conn) sasl.Server {
+			return &xoauth2Server{conn: conn, endpoint: &testTokenEndpoint{}}
+		})
+	})
+	account := testOAuth2Account(endpoint, addr)
+
+	if _, err := dialImapMailSource(account); err == nil {
+		t.Fatal("expected the login to fail")
+	}
+	// a new token was just issued, so there is no second attempt
+	if _, requests := endpoint.issued(); requests != 1 {
+		t.Fatalf("the token endpoint was asked %v times", requests)
+	}
+	if token := storedOAuth2Token(t); token.AccessToken != "" {
+		t.Fatalf("the rejected access token is still stored: %+v", token)
+	}
+}
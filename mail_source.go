@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// how long a fetch waits for the next message before the connection is given up
+var mailFetchTimeout = 10 * time.Second
+
+// MailSource is a connection to the mailbox the invoices are delivered to.
+// The production implementation talks IMAP, the tests also use MemoryMailSource
+// which keeps the messages in memory.
+type MailSource interface {
+	ListMailboxes() ([]string, error)
+	SelectMailbox(name string) (*imap.MailboxStatus, error)
+	// UidFetch returns the messages with UIDs in uidset from the selected mailbox
+	UidFetch(uidset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error)
+	// AddFlag sets a flag on a message, \Deleted ones are removed on the next Expunge
+	AddFlag(uid uint32, flag string) error
+	Expunge() error
+	// MoveMessage moves a message of the selected mailbox to another mailbox
+	MoveMessage(uid uint32, mailbox string) error
+	CreateMailbox(name string) error
+	SupportsIdle() (bool, error)
+	// WaitForNewMail waits in IDLE until the server reports a change of the selected
+	// mailbox or the timeout passes, an error means the connection is unusable
+	WaitForNewMail(timeout time.Duration) error
+	Close() error
+}
+
+// dialMailSource opens a new connection to a mail account
+var dialMailSource = dialImapMailSource
+
+// imapTLSConfig is used for the IMAP connections, nil verifies the server with the
+// system roots
+var imapTLSConfig *tls.Config
+
+type imapMailSource struct {
+	conn *client.Client
+	// signalled when the server reports a change of the selected mailbox
+	mailboxUpdated chan struct{}
+}
+
+func dialImapMailSource(account *MailAccount) (MailSource, error) {
+	conn, err := client.DialTLS(account.ImapAddress, imapTLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	source := &imapMailSource{conn: conn, mailboxUpdated: make(chan struct{}, 1)}
+	// the client blocks when updates aren't consumed, so they are always read
+	updates := make(chan client.Update, 10)
+	conn.Updates = updates
+	go source.watchUpdates(updates)
+	if err := loginMailAccount(conn, account); err != nil {
+		conn.Logout()
+		return nil, err
+	}
+	return source, nil
+}
+
+func (s *imapMailSource) watchUpdates(updates <-chan client.Update) {
+	for {
+		select {
+		case update := <-updates:
+			if _, ok := update.(*client.MailboxUpdate); !ok {
+				continue
+			}
+			select {
+			case s.mailboxUpdated <- struct{}{}:
+			default:
+			}
+		case <-s.conn.LoggedOut():
+			return
+		}
+	}
+}
+
+func (s *imapMailSource) ListMailboxes() ([]string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.conn.List("", "*", mailboxes)
+	}()
+	names := []string{}
+	for m := range mailboxes {
+		names = append(names, m.Name)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (s *imapMailSource) SelectMailbox(name string) (*imap.MailboxStatus, error) {
+	return s.conn.Select(name, false)
+}
+
+// UidFetch closes the connection when the server stops sending messages for
+// mailFetchTimeout, the connection can't be used afterwards
+func (s *imapMailSource) UidFetch(uidset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.conn.UidFetch(uidset, items, messages)
+	}()
+	fetched := []*imap.Message{}
+	timer := time.NewTimer(mailFetchTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				if err := <-done; err != nil {
+					return nil, err
+				}
+				return fetched, nil
+			}
+			fetched = append(fetched, msg)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(mailFetchTimeout)
+		case <-timer.C:
+			// closing the connection ends the fetch, the messages it still
+			// delivers are drained so that it doesn't block on the channel
+			s.conn.Terminate()
+			for range messages {
+			}
+			<-done
+			return nil, errors.New("Timeout")
+		}
+	}
+}
+
+func (s *imapMailSource) AddFlag(uid uint32, flag string) error {
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(uid)
+	flags := []any{flag}
+	return s.conn.UidStore(uidset, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil)
+}
+
+// MoveMessage uses the MOVE extension, go-imap falls back to COPY, STORE \Deleted
+// and EXPUNGE when the server doesn't support it
+func (s *imapMailSource) MoveMessage(uid uint32, mailbox string) error {
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(uid)
+	return s.conn.UidMove(uidset, mailbox)
+}
+
+func (s *imapMailSource) CreateMailbox(name string) error {
+	return s.conn.Create(name)
+}
+
+func (s *imapMailSource) Expunge() error {
+	return s.conn.Expunge(nil)
+}
+
+func (s *imapMailSource) SupportsIdle() (bool, error) {
+	return s.conn.Support("IDLE")
+}
+
+func (s *imapMailSource) WaitForNewMail(timeout time.Duration) error {
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.conn.Idle(stop, nil)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.mailboxUpdated:
+	case <-timer.C:
+	case err := <-done:
+		if err == nil {
+			err = errors.New("IDLE ended unexpectedly")
+		}
+		return err
+	}
+	close(stop)
+	return <-done
+}
+
+func (s *imapMailSource) Close() error {
+	return s.conn.Logout()
+}
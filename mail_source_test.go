@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// startTestImapServer serves go-imap's memory backend over TLS on localhost and makes
+// the IMAP connections trust it. The backend has the user "username" with the
+// password "password" and one plain text message in INBOX. configure runs before the
+// server accepts connections, e.g. to enable more authentication mechanisms.
+func startTestImapServer(t *testing.T, configure ...func(*server.Server, backend.Backend)) (*server.Server, backend.Backend, string) {
+	t.Helper()
+	// borrow the certificate httptest generates for 127.0.0.1
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certServer.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkd := memory.New()
+	srv := server.New(bkd)
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	for _, f := range configure {
+		f(srv, bkd)
+	}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	previous := imapTLSConfig
+	imapTLSConfig = certServer.Client().Transport.(*http.Transport).TLSClientConfig
+	t.Cleanup(func() { imapTLSConfig = previous })
+	return srv, bkd, listener.Addr().String()
+}
+
+// deliverTestEmail appends a message to a mailbox of the memory backend
+func deliverTestEmail(t *testing.T, bkd backend.Backend, mailbox string, raw []byte) {
+	t.Helper()
+	user, err := bkd.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox(mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBuffer(raw)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMailboxMessages(t *testing.T, bkd backend.Backend, mailbox string) []*memory.Message {
+	t.Helper()
+	user, err := bkd.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox(mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox.(*memory.Mailbox).Messages
+}
+
+func TestImapMailSourceCheckAndDelete(t *testing.T) {
+	setupTestBot(t)
+	_, bkd, addr := startTestImapServer(t)
+	config.EmailProcessedAction = EmailActionDelete
+	account := &MailAccount{Name: "test", ImapAddress: addr, ImapUsername: "username", ImapPassword: "password"}
+
+	deliverTestEmail(t, bkd, "INBOX", testEmail("billing@acme.example", "Invoice for March", testAttachment{"faktura.pdf", "application/pdf", readTestdata(t, "invoice_simple.pdf")}))
+	stats, err := checkMailFolder(account, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the memory backend starts with a plain text message
+	if stats.EmailsChecked != 2 || stats.Attachments != 2 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if count := countInvoices(t); count != 1 {
+		t.Fatalf("expected one invoice, got %v", count)
+	}
+	if messages := testMailboxMessages(t, bkd, "INBOX"); len(messages) != 0 {
+		t.Fatalf("expected the handled messages to be deleted, %v left", len(messages))
+	}
+}
+
+func TestImapMailSourceWrongPassword(t *testing.T) {
+	setupTestBot(t)
+	_, _, addr := startTestImapServer(t)
+	account := &MailAccount{Name: "test", ImapAddress: addr, ImapUsername: "username", ImapPassword: "wrong"}
+	if _, err := checkMailFolder(account, "INBOX"); err == nil {
+		t.Fatal("expected the login to fail")
+	}
+}
+
+func TestImapMailSourceListsMailboxes(t *testing.T) {
+	setupTestBot(t)
+	_, _, addr := startTestImapServer(t)
+	conn, err := dialImapMailSource(&MailAccount{ImapAddress: addr, ImapUsername: "username", ImapPassword: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.CreateMailbox("Processed"); err != nil {
+		t.Fatal(err)
+	}
+	mailboxes, err := conn.ListMailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, name := range mailboxes {
+		found[name] = true
+	}
+	if !found["INBOX"] || !found["Processed"] {
+		t.Fatalf("unexpected mailboxes: %v", mailboxes)
+	}
+}
+
+// startSlowImapServer serves a preauthenticated connection which answers a UID FETCH
+// with messageCount messages, sending one every interval. It returns the address and
+// a channel closed once the client disconnected.
+func startSlowImapServer(t *testing.T, messageCount int, interval time.Duration) (string, <-chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	disconnected := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(disconnected)
+		defer conn.Close()
+		io.WriteString(conn, "* PREAUTH [CAPABILITY IMAP4rev1] ready\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			tag, command := fields[0], strings.ToUpper(fields[1])
+			switch command {
+			case "SELECT":
+				fmt.Fprintf(conn, "* %v EXISTS\r\n%v OK [READ-WRITE] SELECT completed\r\n", messageCount, tag)
+			case "UID":
+				for i := 1; i <= messageCount; i++ {
+					time.Sleep(interval)
+					if _, err := fmt.Fprintf(conn, "* %v FETCH (UID %v FLAGS ())\r\n", i, i); err != nil {
+						return
+					}
+				}
+				fmt.Fprintf(conn, "%v OK UID FETCH completed\r\n", tag)
+			case "LOGOUT":
+				fmt.Fprintf(conn, "* BYE\r\n%v OK LOGOUT completed\r\n", tag)
+				return
+			default:
+				fmt.Fprintf(conn, "%v OK completed\r\n", tag)
+			}
+		}
+	}()
+	return listener.Addr().String(), disconnected
+}
+
+func fetchFromSlowImapServer(t *testing.T, addr string) ([]*imap.Message, error) {
+	t.Helper()
+	conn, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &imapMailSource{conn: conn, mailboxUpdated: make(chan struct{}, 1)}
+	if _, err := source.SelectMailbox("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	uidset := new(imap.SeqSet)
+	uidset.AddRange(1, 0)
+	messages, fetchErr := source.UidFetch(uidset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags})
+	if fetchErr == nil {
+		source.Close()
+	}
+	return messages, fetchErr
+}
+
+func TestImapMailSourceFetchTimeoutIsPerMessage(t *testing.T) {
+	previous := mailFetchTimeout
+	mailFetchTimeout = 300 * time.Millisecond
+	t.Cleanup(func() { mailFetchTimeout = previous })
+	// the whole fetch takes longer than the timeout, every message arrives in time
+	addr, _ := startSlowImapServer(t, 5, 100*time.Millisecond)
+	messages, err := fetchFromSlowImapServer(t, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 5 {
+		t.Fatalf("expected 5 messages, got %v", len(messages))
+	}
+}
+
+func TestImapMailSourceFetchTimeoutClosesTheConnection(t *testing.T) {
+	previous := mailFetchTimeout
+	mailFetchTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { mailFetchTimeout = previous })
+	addr, disconnected := startSlowImapServer(t, 30, time.Second)
+	before := runtime.NumGoroutine()
+	if _, err := fetchFromSlowImapServer(t, addr); err == nil {
+		t.Fatal("expected the fetch to time out")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't closed after the timeout")
+	}
+	// the goroutines of the fetch and of the client end with the connection
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%v goroutines left running after the fetch", n-before)
+	}
+}
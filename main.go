@@ -1,13 +1,9 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
+	"html"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -20,13 +16,11 @@ import (
 	"gorm.io/gorm"
 )
 
-var bot *tgbotapi.BotAPI
 var db *gorm.DB
 
 func sendError(chatID int64, err error) {
 	log.Printf("sending error error: %v", err)
-	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Error: %v", err))
-	bot.Send(msg)
+	messenger.SendText(OutgoingMessage{ChatID: chatID, Text: fmt.Sprintf("Error: %v", err)})
 }
 
 func checkAuthorization(update tgbotapi.Update, command, args string, chatID int64) *AuthorizedUser {
@@ -36,24 +30,44 @@ func checkAuthorization(update tgbotapi.Update, command, args string, chatID int
 	} else if update.CallbackQuery != nil {
 		from = update.CallbackQuery.From
 	}
-	if command == "authorize" {
+	if command == "authorize" && update.Message != nil {
+		// the bot token only bootstraps the first admin, everyone else needs an invite
+		var userCount int64
+		if err := db.Model(&AuthorizedUser{}).Count(&userCount).Error; err != nil {
+			sendError(chatID, err)
+			return nil
+		}
+		if userCount > 0 {
+			messenger.SendText(OutgoingMessage{ChatID: chatID, Text: "The bot already has users, ask an admin for an invite link."})
+			return nil
+		}
 		if args != config.TelegramToken {
 			log.Printf("wrong token")
-			msg := tgbotapi.NewMessage(chatID, "Please provide a valid bot token as an argument to authorize.")
-			bot.Send(msg)
+			messenger.SendText(OutgoingMessage{ChatID: chatID, Text: "Please provide a valid bot token as an argument to authorize."})
 			return nil
 		}
 		user := &AuthorizedUser{
 			TelegramID: from.ID,
 			UserName:   from.UserName,
+			Role:       RoleAdmin,
 		}
 		if err := db.Create(&user).Error; err != nil {
 			sendError(chatID, err)
 			return nil
 		}
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("User %v authorized", from.ID))
-		msg.ReplyToMessageID = update.Message.MessageID
-		bot.Send(msg)
+		recordAuditEvent(user.AuditActor(), AuditUserAuthorized, 0, "bootstrap admin authorized with the bot token")
+		replyText(update.Message.Chat.ID, update.Message.MessageID, fmt.Sprintf("User %v authorized as %v", from.ID, RoleAdmin))
+		return nil
+	}
+	if command == "start" && args != "" && update.Message != nil {
+		user, err := redeemInviteCode(strings.TrimSpace(args), from.ID, from.UserName)
+		if err != nil {
+			sendError(chatID, err)
+			return nil
+		}
+		log.Printf("user %v redeemed an invite from %v", from.ID, user.InvitedBy)
+		recordAuditEvent(user.AuditActor(), AuditUserAuthorized, 0, fmt.Sprintf("redeemed an invite from %v as %v", user.InvitedBy, user.Role))
+		replyText(update.Message.Chat.ID, update.Message.MessageID, fmt.Sprintf("Welcome! You are now authorized as %v.", user.Role))
 		return nil
 	}
 	// check if user is authorized
@@ -91,21 +105,34 @@ func HandleMessage(update tgbotapi.Update) {
 		}
 		chatID = update.CallbackQuery.Message.Chat.ID
 		messageID = update.CallbackQuery.Message.MessageID
+		// stop the loading indicator on the pressed button
+		if err := messenger.AnswerCallback(update.CallbackQuery.ID, ""); err != nil {
+			log.Printf("error answering callback query: %v", err)
+		}
 	}
 	authorizedUser := checkAuthorization(update, command, args, chatID)
 	if authorizedUser == nil {
 		return
 	}
 	log.Printf("command: %v, args: %v", command, args)
+	if role, ok := commandRoles[command]; ok && !authorizedUser.HasRole(role) {
+		sendError(chatID, fmt.Errorf("/%v requires the %v role, you are %v", command, role, authorizedUser.Role))
+		return
+	}
+	// the new name or file of an invoice being renamed or replaced
+	if update.Message != nil && authorizedUser.HasRole(commandRoles["invoice"]) &&
+		handlePendingInvoiceAction(update.Message, command, authorizedUser) {
+		return
+	}
 	switch command {
 	case "invoices":
 		if args == "" {
-			months, err := db.Raw("SELECT strftime('%Y-%m', created_at) as month, COUNT(*) as count FROM invoices  GROUP BY month ORDER BY month DESC").Rows()
+			months, err := db.Raw("SELECT printf('%04d-%02d', billing_year, billing_month) as month, COUNT(*) as count FROM invoices WHERE deleted_at IS NULL GROUP BY month ORDER BY month DESC").Rows()
 			if err != nil {
 				sendError(chatID, err)
 				return
 			}
-			keyboard := tgbotapi.NewInlineKeyboardMarkup()
+			buttons := [][]MessageButton{}
 			for months.Next() {
 				var month string
 				var count int
@@ -115,109 +142,291 @@ func HandleMessage(update tgbotapi.Update) {
 				if count > 1 {
 					countStr += "s"
 				}
-				keyboard.InlineKeyboard = append(
-					keyboard.InlineKeyboard,
-					tgbotapi.NewInlineKeyboardRow(
-						tgbotapi.NewInlineKeyboardButtonData(month+" ("+countStr+")", "/invoices "+month),
-					))
+				buttons = append(buttons, []MessageButton{
+					{Text: month + " (" + countStr + ")", Data: "/invoices " + month},
+				})
 			}
 
-			msg := tgbotapi.NewMessage(chatID, "Provide a year and a month (YYYY-MM) as an argument to get invoices for a specific month.")
-			msg.ReplyToMessageID = messageID
-			msg.ReplyMarkup = keyboard
-			bot.Send(msg)
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             "Provide a year and a month (YYYY-MM) as an argument to get invoices for a specific month.",
+				ReplyToMessageID: messageID,
+				Buttons:          buttons,
+			})
 			return
 		}
 
-		month := args
-		month = strings.TrimSpace(month)
-		var invoices []Invoice
-		if err := db.Where("strftime('%Y-%m', created_at) = ?", month).Find(&invoices).Error; err != nil {
+		// "YYYY-MM page N" comes from the pagination buttons
+		parts := strings.Fields(args)
+		if len(parts) == 0 {
+			sendError(chatID, fmt.Errorf("usage: /invoices [YYYY-MM]"))
+			return
+		}
+		month := parts[0]
+		page := 0
+		if len(parts) == 3 && parts[1] == "page" {
+			page, _ = strconv.Atoi(parts[2])
+		}
+		parsedYear, parsedMonth, err := parseYearMonth(month)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		invoices, err := findMonthInvoices(parsedYear, parsedMonth)
+		if err != nil {
 			sendError(chatID, err)
 			return
 		}
 		if len(invoices) == 0 {
-			msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("No invoices found for %v", month))
-			msg.ReplyToMessageID = messageID
-			bot.Send(msg)
+			replyText(chatID, messageID, fmt.Sprintf("No invoices found for %v", month))
 			return
 		}
-		invoicesStr := ""
-		for _, invoice := range invoices {
-			date := invoice.CreatedAt.Format("2006-01-02")
-			invoicesStr += fmt.Sprintf("%v: %v\n", date, invoice.FileName)
+		text, buttons := renderInvoicesPage(month, invoices, page, authorizedUser.HasRole(commandRoles["invoice"]))
+		if page > 0 && update.CallbackQuery != nil {
+			// turning pages edits the listing in place instead of sending the ZIP again
+			if err := messenger.EditText(messageID, OutgoingMessage{ChatID: chatID, Text: text, Buttons: buttons}); err != nil {
+				sendError(chatID, err)
+			}
+			return
+		}
+		messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             text,
+			ReplyToMessageID: messageID,
+			Buttons:          buttons,
+		})
+		progressMsgID, err := messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             "Generating ZIP file...",
+			ReplyToMessageID: messageID,
+		})
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		zipPath, generatedZip, err := generateMonthZip(parsedYear, parsedMonth, invoices, authorizedUser.AuditActor())
+		if err != nil {
+			messenger.DeleteMessage(chatID, progressMsgID)
+			sendError(chatID, err)
+			return
+		}
+		defer os.Remove(zipPath)
+		zipFile := OutgoingDocument{
+			FileName: generatedZip.FileName,
+			Path:     zipPath,
+		}
+		if err := messenger.SendDocuments(chatID, 0, []OutgoingDocument{zipFile}); err != nil {
+			sendError(chatID, err)
+		}
+
+		//delete progressMsg
+		messenger.DeleteMessage(chatID, progressMsgID)
 
+		if isAccountingEmailConfigured() && authorizedUser.HasRole(commandRoles["sendzip"]) {
+			messenger.SendText(OutgoingMessage{
+				ChatID:  chatID,
+				Text:    fmt.Sprintf("Send this package to accounting (%v)?", config.AccountingEmail),
+				Buttons: [][]MessageButton{{{Text: "📧 Send to accounting", Data: "/sendzip " + month}}},
+			})
 		}
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Invoices for %v:\n %v", month, invoicesStr))
-		msg.ReplyToMessageID = messageID
-		bot.Send(msg)
-		msg = tgbotapi.NewMessage(chatID, "Generating ZIP file...")
-		msg.ReplyToMessageID = messageID
-		progressMsg, err := bot.Send(msg)
+
+		return
+
+	case "sendzip":
+		if !isAccountingEmailConfigured() {
+			sendError(chatID, fmt.Errorf("sending to accounting is not configured"))
+			return
+		}
+		parts := strings.Fields(args)
+		if len(parts) == 0 {
+			sendError(chatID, fmt.Errorf("usage: /sendzip <YYYY-MM>"))
+			return
+		}
+		month := parts[0]
+		year, monthNum, err := parseYearMonth(month)
 		if err != nil {
 			sendError(chatID, err)
 			return
 		}
-		buf := new(bytes.Buffer)
-		w := zip.NewWriter(buf)
-		for _, invoice := range invoices {
-			month := invoice.CreatedAt.Format("2006-01")
-			f, err := w.Create("GK_faktury_" + month + "/" + invoice.FileName)
+		if len(parts) > 1 && parts[1] == "cancel" {
+			replyText(chatID, messageID, fmt.Sprintf("Not sending %v to accounting.", month))
+			return
+		}
+		invoices, err := findMonthInvoices(year, monthNum)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		if len(invoices) == 0 {
+			replyText(chatID, messageID, fmt.Sprintf("No invoices found for %v", month))
+			return
+		}
+		if len(parts) < 2 || parts[1] != "confirm" {
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             fmt.Sprintf("Send %v invoices for %v to %v?", len(invoices), month, config.AccountingEmail),
+				ReplyToMessageID: messageID,
+				Buttons: [][]MessageButton{{
+					{Text: "✅ Send", Data: "/sendzip " + month + " confirm"},
+					{Text: "Cancel", Data: "/sendzip " + month + " cancel"},
+				}},
+			})
+			return
+		}
+		progressMsgID, _ := messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             "Sending e-mail...",
+			ReplyToMessageID: messageID,
+		})
+		generatedZip, err := sendMonthToAccounting(year, monthNum, invoices, authorizedUser.AuditActor())
+		messenger.DeleteMessage(chatID, progressMsgID)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		notifyAllChats(fmt.Sprintf("Sent <b>%v</b> (%v invoices) to <b>%v</b>.\nMarking month %v as sent.",
+			html.EscapeString(generatedZip.FileName), len(invoices), html.EscapeString(config.AccountingEmail), month))
+		// the chat might not be subscribed to notifications
+		if !isNotifiedChat(chatID) {
+			replyText(chatID, messageID, fmt.Sprintf("Sent %v to %v.", generatedZip.FileName, config.AccountingEmail))
+		}
+
+	case "setmonth":
+		parts := strings.Fields(args)
+		if len(parts) != 2 {
+			sendError(chatID, fmt.Errorf("usage: /setmonth <invoice id> <YYYY-MM>"))
+			return
+		}
+		invoiceID, err := strconv.Atoi(strings.TrimPrefix(parts[0], "#"))
+		if err != nil {
+			sendError(chatID, fmt.Errorf("invalid invoice id: %v", parts[0]))
+			return
+		}
+		year, month, err := parseYearMonth(parts[1])
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		invoice := &Invoice{}
+		if err := db.First(&invoice, invoiceID).Error; err != nil {
+			sendError(chatID, fmt.Errorf("invoice #%v not found: %v", invoiceID, err))
+			return
+		}
+		previousPeriod := invoice.BillingPeriod()
+		if err := moveInvoice(invoice, year, month, authorizedUser.AuditActor()); err != nil {
+			sendError(chatID, err)
+			return
+		}
+		reply := fmt.Sprintf("Invoice %v moved from %v to %v", invoice.FileName, previousPeriod, invoice.BillingPeriod())
+		if warning := lateInvoiceWarning(invoice); warning != "" {
+			reply += "\n\n" + warning
+		}
+		replyText(chatID, messageID, reply)
+	case "apitoken":
+		parts := strings.Fields(args)
+		if len(parts) == 0 {
+			var tokens []ApiToken
+			if err := db.Find(&tokens).Error; err != nil {
+				sendError(chatID, err)
+				return
+			}
+			tokensStr := ""
+			for _, token := range tokens {
+				lastUsed := "never"
+				if token.LastUsedAt != nil {
+					lastUsed = token.LastUsedAt.Format("2006-01-02 15:04")
+				}
+				tokensStr += fmt.Sprintf("#%v %v (last used: %v)\n", token.ID, token.Name, lastUsed)
+			}
+			replyText(chatID, messageID, "API tokens:\n"+tokensStr+"\nUse /apitoken new <name> to create a token and /apitoken revoke <id> to revoke one.")
+			return
+		}
+		if parts[0] == "new" && len(parts) > 1 {
+			name := strings.Join(parts[1:], " ")
+			token, apiToken, err := createApiToken(name, authorizedUser.TelegramID)
 			if err != nil {
 				sendError(chatID, err)
+				return
+			}
+			recordAuditEvent(authorizedUser.AuditActor(), AuditApiTokenCreated, 0, fmt.Sprintf("#%v %v", apiToken.ID, name))
+			replyText(chatID, messageID, fmt.Sprintf("Created API token #%v for %v:\n%v\n\nIt won't be shown again.", apiToken.ID, name, token))
+			return
+		}
+		if parts[0] == "revoke" && len(parts) == 2 {
+			id, err := strconv.Atoi(strings.TrimPrefix(parts[1], "#"))
+			if err != nil {
+				sendError(chatID, fmt.Errorf("invalid token id: %v", parts[1]))
+				return
+			}
+			result := db.Delete(&ApiToken{}, id)
+			if result.Error != nil {
+				sendError(chatID, result.Error)
+				return
+			}
+			if result.RowsAffected == 0 {
+				sendError(chatID, fmt.Errorf("API token #%v not found", id))
+				return
 			}
-			if _, err := f.Write(invoice.Contents); err != nil {
+			recordAuditEvent(authorizedUser.AuditActor(), AuditApiTokenRevoked, 0, fmt.Sprintf("#%v", id))
+			replyText(chatID, messageID, fmt.Sprintf("API token #%v revoked", id))
+			return
+		}
+		sendError(chatID, fmt.Errorf("usage: /apitoken [new <name> | revoke <id>]"))
+	case "users", "authorized":
+		handleUsersCommand(chatID, messageID, args, authorizedUser)
+	case "audit":
+		handleAuditCommand(chatID, messageID, args)
+	case "invite":
+		role := RoleViewer
+		if args != "" {
+			var err error
+			if role, err = parseRole(strings.TrimSpace(args)); err != nil {
 				sendError(chatID, err)
+				return
 			}
 		}
-		if err := w.Close(); err != nil {
+		invite, err := createInviteCode(role, authorizedUser.TelegramID)
+		if err != nil {
 			sendError(chatID, err)
+			return
 		}
-		zipFile := tgbotapi.FileBytes{
-			Name:  "GK_faktury_" + month + ".zip",
-			Bytes: buf.Bytes(),
-		}
-		zipSha256 := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
-		parsedYear, err := strconv.Atoi(month[:4])
-		parsedMonth, err := strconv.Atoi(month[5:])
-		db.Where("sha256 = ?", zipSha256).FirstOrCreate(&GeneratedZip{
-			Sha256:   zipSha256,
-			FileName: zipFile.Name,
-			Year:     parsedYear,
-			Month:    parsedMonth,
-		})
-		mediaInput := tgbotapi.NewInputMediaDocument(zipFile)
-		mg := tgbotapi.NewMediaGroup(chatID, []any{mediaInput})
-		if _, err := bot.SendMediaGroup(mg); err != nil {
+		recordAuditEvent(authorizedUser.AuditActor(), AuditInviteCreated, 0, fmt.Sprintf("invite #%v for a %v", invite.ID, role))
+		replyText(chatID, messageID, fmt.Sprintf("Invite for a new %v, valid until %v and usable once:\n%v",
+			role, invite.ExpiresAt.Format("2006-01-02 15:04"), inviteLink(invite.Code)))
+	case "setrole":
+		parts := strings.Fields(args)
+		if len(parts) != 2 {
+			sendError(chatID, fmt.Errorf("usage: /setrole <telegram id> <viewer|uploader|admin>"))
+			return
+		}
+		telegramID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			sendError(chatID, fmt.Errorf("invalid telegram id: %v", parts[0]))
+			return
+		}
+		role, err := parseRole(parts[1])
+		if err != nil {
 			sendError(chatID, err)
+			return
 		}
-
-		//delete progressMsg
-		deleteMsg := tgbotapi.NewDeleteMessage(chatID, progressMsg.MessageID)
-		bot.Send(deleteMsg)
-
-		return
-
-	case "authorized":
-		var users []AuthorizedUser
-		if err := db.Find(&users).Error; err != nil {
+		user, err := setUserRole(telegramID, role)
+		if err != nil {
 			sendError(chatID, err)
 			return
 		}
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Authorized users: %#v", users))
-		msg.ReplyToMessageID = messageID
-		bot.Send(msg)
+		recordAuditEvent(authorizedUser.AuditActor(), AuditUserRoleChanged, 0, fmt.Sprintf("%v is now %v", user.AuditActor(), role))
+		replyText(chatID, messageID, fmt.Sprintf("%v is now %v", user.DisplayName(), role))
 	case "notifications":
 		if args == "" {
-			msg := tgbotapi.NewMessage(chatID, "Choose whether you want to receive notifications to send invoices on this chat.")
-			msg.ReplyToMessageID = messageID
-			msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("Yes", "/notifications yes"),
-					tgbotapi.NewInlineKeyboardButtonData("No", "/notifications no"),
-				),
-			)
-			bot.Send(msg)
+			messenger.SendText(OutgoingMessage{
+				ChatID:           chatID,
+				Text:             "Choose whether you want to receive notifications to send invoices on this chat.",
+				ReplyToMessageID: messageID,
+				Buttons: [][]MessageButton{{
+					{Text: "Yes", Data: "/notifications yes"},
+					{Text: "No", Data: "/notifications no"},
+				}},
+			})
 			return
 		}
 		args = strings.TrimSpace(args)
@@ -226,69 +435,123 @@ func HandleMessage(update tgbotapi.Update) {
 				sendError(chatID, err)
 				return
 			}
-			msg := tgbotapi.NewMessage(chatID, "You will now receive notifications to send invoices on this chat.")
-			msg.ReplyToMessageID = messageID
-			bot.Send(msg)
+			recordAuditEvent(authorizedUser.AuditActor(), AuditNotificationsEnabled, 0, fmt.Sprintf("chat %v", chatID))
+			replyText(chatID, messageID, "You will now receive notifications to send invoices on this chat.")
 			return
 		} else if args == "no" {
 			if err := db.Where("telegram_chat_id = ?", chatID).Delete(&NotifiedChat{}).Error; err != nil {
 				sendError(chatID, err)
 				return
 			}
-			msg := tgbotapi.NewMessage(chatID, "You will no longer receive notifications to send invoices on this chat.")
-			msg.ReplyToMessageID = messageID
-			bot.Send(msg)
+			recordAuditEvent(authorizedUser.AuditActor(), AuditNotificationsDisabled, 0, fmt.Sprintf("chat %v", chatID))
+			replyText(chatID, messageID, "You will no longer receive notifications to send invoices on this chat.")
 			return
 		} else {
 			sendError(chatID, fmt.Errorf("invalid argument: %v (expected yes or no)", args))
 			return
 		}
-	case "checkemail":
-		msg := tgbotapi.NewMessage(chatID, "Checking email...")
-		msg.ReplyToMessageID = messageID
-		progressMsg, err := bot.Send(msg)
-		stats, err := doCheckEmail()
-		// delete progressMsg
-		bot.Send(tgbotapi.NewDeleteMessage(chatID, progressMsg.MessageID))
+	case "search":
+		invoices, err := searchInvoices(args)
 		if err != nil {
+			sendError(chatID, fmt.Errorf("%v\nusage: /search <words> [YYYY or YYYY-MM]", err))
+			return
+		}
+		if len(invoices) == 0 {
+			replyText(chatID, messageID, "No invoices found")
+			return
+		}
+		resultsStr := ""
+		buttons := [][]MessageButton{}
+		for _, invoice := range invoices {
+			resultsStr += fmt.Sprintf("#%v %v: %v", invoice.ID, invoice.BillingPeriod(), invoice.FileName)
+			if invoice.GrossAmount != nil {
+				resultsStr += " (" + formatAmount(*invoice.GrossAmount, invoice.Currency) + ")"
+			}
+			if source := invoice.Source.Describe(); source != "" {
+				resultsStr += ", " + source
+			}
+			resultsStr += "\n"
+			buttons = append(buttons, []MessageButton{invoiceDownloadButton(invoice)})
+		}
+		title := "Found invoices:\n"
+		if len(invoices) == searchResultsLimit {
+			title = fmt.Sprintf("First %v found invoices, refine the query to see others:\n", searchResultsLimit)
+		}
+		messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             title + resultsStr,
+			ReplyToMessageID: messageID,
+			Buttons:          buttons,
+		})
+	case "invoice":
+		handleInvoiceCommand(chatID, messageID, args, authorizedUser)
+	case "duplicate":
+		handleDuplicateCommand(chatID, messageID, args, authorizedUser)
+	case "download":
+		invoiceID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+		if err != nil {
+			sendError(chatID, fmt.Errorf("usage: /download <invoice id>"))
+			return
+		}
+		invoice := &Invoice{}
+		if err := db.First(&invoice, invoiceID).Error; err != nil {
+			sendError(chatID, fmt.Errorf("invoice #%v not found", invoiceID))
+			return
+		}
+		contents, err := readBlob(invoice.Sha256)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		doc := OutgoingDocument{FileName: invoice.FileName, Contents: contents}
+		if err := messenger.SendDocuments(chatID, messageID, []OutgoingDocument{doc}); err != nil {
 			sendError(chatID, err)
 			return
 		}
-		msg = tgbotapi.NewMessage(chatID, fmt.Sprintf("Checked %v emails, found %v attachments", stats.EmailsChecked, stats.Attachments))
-		msg.ReplyToMessageID = messageID
-		bot.Send(msg)
+		recordAuditEvent(authorizedUser.AuditActor(), AuditInvoiceDownloaded, invoice.ID, invoice.FileName)
+	case "checkemail":
+		progressMsgID, _ := messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             "Checking email...",
+			ReplyToMessageID: messageID,
+		})
+		statuses := doCheckEmail()
+		// delete progressMsg
+		messenger.DeleteMessage(chatID, progressMsgID)
+		if len(statuses) == 0 {
+			replyText(chatID, messageID, "No mail accounts are configured")
+			return
+		}
+		replyText(chatID, messageID, strings.Join(statuses, "\n"))
 	}
 
 	// handle invoice upload
 	if update.Message != nil && update.Message.Document != nil {
 		log.Printf("got document: %#v", update.Message.Document)
-		file, err := bot.GetFileDirectURL(update.Message.Document.FileID)
-		if err != nil {
-			sendError(chatID, err)
+		if !authorizedUser.HasRole(RoleUploader) {
+			sendError(chatID, fmt.Errorf("uploading invoices requires the %v role, you are %v", RoleUploader, authorizedUser.Role))
 			return
 		}
-		log.Printf("got file url: %v", file)
-		resp, err := http.Get(file)
+		data, err := messenger.DownloadFile(update.Message.Document.FileID)
 		if err != nil {
 			sendError(chatID, err)
 			return
 		}
-		defer resp.Body.Close()
 
-		data, err := ioutil.ReadAll(resp.Body)
+		invoice, err := processIncomingInvoice(update.Message.Document.FileName, data, newTelegramInvoiceSource(authorizedUser))
 		if err != nil {
 			sendError(chatID, err)
 			return
 		}
-
-		if err := processIncomingInvoice(update.Message.Document.FileName, data); err != nil {
-			sendError(chatID, err)
-			return
+		reply := fmt.Sprintf("Invoice %v saved for %v", update.Message.Document.FileName, invoice.BillingPeriod())
+		if summary := invoice.MetadataSummary(); summary != "" {
+			reply += "\n" + summary
 		}
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Invoice %v saved", update.Message.Document.FileName))
-		msg.ReplyToMessageID = update.Message.MessageID
-		bot.Send(msg)
-
+		if warning := lateInvoiceWarning(invoice); warning != "" {
+			reply += "\n\n" + warning
+		}
+		replyText(update.Message.Chat.ID, update.Message.MessageID, reply)
+		askAboutDuplicate(chatID, update.Message.MessageID, invoice)
 	}
 
 }
@@ -308,8 +571,7 @@ func main() {
 	}
 
 	// Migrate the schema
-	err = db.AutoMigrate(&AuthorizedUser{}, &Invoice{}, &NotifiedChat{}, &GeneratedZip{})
-	if err != nil {
+	if err := migrateDatabase(); err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
 
@@ -317,13 +579,18 @@ func main() {
 		log.Fatalf("GK_INVOICES_BOT_TOKEN is not set")
 	}
 
-	bot, err = tgbotapi.NewBotAPI(config.TelegramToken)
+	bot, err := tgbotapi.NewBotAPI(config.TelegramToken)
 	if err != nil {
 		log.Fatalf("failed to create bot: %v", err)
 	}
 	log.Printf("Authorized on account %s", bot.Self.UserName)
+	botUserName = bot.Self.UserName
+	messenger = NewTelegramMessenger(bot)
 	go runNotificationsLoop()
 	go runEmailCheckerLoop()
+	if config.HttpListenAddress != "" {
+		go runWebServer()
+	}
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 	updates := bot.GetUpdatesChan(u)
@@ -337,18 +604,54 @@ func main() {
 			Command:     "invoices",
 			Description: "Get invoices list for a given month",
 		},
+		{
+			Command:     "sendzip",
+			Description: "E-mail the invoices of a month (YYYY-MM) to accounting.",
+		},
+		{
+			Command:     "search",
+			Description: "Search invoices by file name, e-mail subject, sender or contents.",
+		},
+		{
+			Command:     "download",
+			Description: "Download a single invoice (by its #ID).",
+		},
+		{
+			Command:     "invoice",
+			Description: "Delete, rename, move or replace an invoice (by its #ID).",
+		},
+		{
+			Command:     "setmonth",
+			Description: "Move an invoice to another billing month, provide the invoice id and YYYY-MM.",
+		},
 		{
 			Command:     "authorize",
 			Description: "Authorize yourself to use the bot, provide a bot token as an argument.",
 		},
 		{
-			Command:     "authorized",
-			Description: "Get a list of authorized users",
+			Command:     "users",
+			Description: "List authorized users, change their roles or revoke access.",
+		},
+		{
+			Command:     "invite",
+			Description: "Create a single-use invite link for a viewer, uploader or admin.",
+		},
+		{
+			Command:     "setrole",
+			Description: "Change the role of a user (viewer, uploader or admin).",
+		},
+		{
+			Command:     "audit",
+			Description: "Show recent audit events, of a single invoice (#ID) or export all of them (export).",
 		},
 		{
 			Command:     "notifications",
 			Description: "Enable or disable notifications after the end of each month.",
 		},
+		{
+			Command:     "apitoken",
+			Description: "List, create (new <name>) or revoke (revoke <id>) API tokens.",
+		},
 		{
 			Command:     "checkemail",
 			Description: "Check email for invoices and send them to the bot.",
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"os"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testChatID = int64(1000)
+	testUserID = int64(42)
+)
+
+// setupTestBot points the bot at a fresh database and storage directory and
+// returns the messenger everything is sent through. testUserID is an admin.
+func setupTestBot(t *testing.T) *RecordingMessenger {
+	t.Helper()
+	dir := t.TempDir()
+	config = Config{
+		StorageDir:             dir,
+		NotificationsStartTime: &TimeOfDay{},
+		NotificationsEndTime:   &TimeOfDay{Hour: 23, Minute: 59},
+	}
+	var err error
+	db, err = gorm.Open(sqlite.Open(dir+"/test.db"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&AuthorizedUser{TelegramID: testUserID, UserName: "tester", Role: RoleAdmin}).Error; err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewRecordingMessenger()
+	messenger = recorder
+	return recorder
+}
+
+var nextTestMessageID = 1
+
+func testUser() *tgbotapi.User {
+	return &tgbotapi.User{ID: testUserID, UserName: "tester"}
+}
+
+// sendCommand delivers a command message like "/invoices 2023-03" to HandleMessage
+func sendCommand(text string) {
+	sendCommandAs(testUser(), text)
+}
+
+// sendCommandAs delivers a command message from another user to the test chat
+func sendCommandAs(user *tgbotapi.User, text string) {
+	nextTestMessageID++
+	command := strings.Fields(text)[0]
+	HandleMessage(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: nextTestMessageID,
+		From:      user,
+		Chat:      &tgbotapi.Chat{ID: testChatID},
+		Text:      text,
+		Entities:  []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}},
+	}})
+}
+
+// pressButton delivers the callback query of an inline keyboard button
+func pressButton(data string) {
+	nextTestMessageID++
+	HandleMessage(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:      "cb",
+		From:    testUser(),
+		Message: &tgbotapi.Message{MessageID: nextTestMessageID, Chat: &tgbotapi.Chat{ID: testChatID}},
+		Data:    data,
+	}})
+}
+
+// uploadDocument sends a file to the bot like a Telegram user would
+func uploadDocument(recorder *RecordingMessenger, fileName string, contents []byte) {
+	uploadDocumentAs(recorder, testUser(), fileName, contents)
+}
+
+// uploadDocumentAs sends a file to the bot from another user
+func uploadDocumentAs(recorder *RecordingMessenger, user *tgbotapi.User, fileName string, contents []byte) {
+	nextTestMessageID++
+	recorder.Files[fileName] = contents
+	HandleMessage(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: nextTestMessageID,
+		From:      user,
+		Chat:      &tgbotapi.Chat{ID: testChatID},
+		Document:  &tgbotapi.Document{FileID: fileName, FileName: fileName},
+	}})
+}
+
+func readTestdata(t testing.TB, name string) []byte {
+	t.Helper()
+	contents, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func lastMessage(t *testing.T, recorder *RecordingMessenger, chatID int64) RecordedMessage {
+	t.Helper()
+	msgs := recorder.MessagesTo(chatID)
+	if len(msgs) == 0 {
+		t.Fatalf("no messages sent to chat %v", chatID)
+	}
+	return msgs[len(msgs)-1]
+}
+
+func hasButton(msg RecordedMessage, data string) bool {
+	for _, row := range msg.Buttons {
+		for _, button := range row {
+			if button.Data == data {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestInvoicesListsMonthsAndSendsZip(t *testing.T) {
+	recorder := setupTestBot(t)
+	uploadDocument(recorder, "faktura.pdf", readTestdata(t, "invoice_simple.pdf"))
+	if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, "saved for 2023-03") {
+		t.Fatalf("unexpected upload reply: %q", msg.Text)
+	}
+
+	sendCommand("/invoices")
+	if msg := lastMessage(t, recorder, testChatID); !hasButton(msg, "/invoices 2023-03") {
+		t.Fatalf("month button missing: %+v", msg.Buttons)
+	}
+
+	recorder.Reset()
+	pressButton("/invoices 2023-03")
+	listing := recorder.MessagesTo(testChatID)[0]
+	if !strings.Contains(listing.Text, "faktura.pdf") || !strings.Contains(listing.Text, "FV/12/03/2023") {
+		t.Fatalf("listing doesn't show the invoice: %q", listing.Text)
+	}
+	if len(recorder.Documents) != 1 || len(recorder.Documents[0].Documents) != 1 {
+		t.Fatalf("expected one ZIP, got %+v", recorder.Documents)
+	}
+	zipFile := recorder.Documents[0].Documents[0]
+	reader, err := zip.NewReader(bytes.NewReader(zipFile.Contents), int64(len(zipFile.Contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"GK_faktury_2023-03/faktura.pdf", "GK_faktury_2023-03/index.csv"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("ZIP contains %v, want %v", names, want)
+	}
+	index, err := reader.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(index).ReadAll()
+	index.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sender comes from the source of the invoice
+	if len(rows) != 2 || rows[0][2] != "sender" || rows[1][2] != "@tester" || rows[1][12] != SourceTelegram {
+		t.Fatalf("unexpected index: %q", rows)
+	}
+	// the progress message is removed once the ZIP is sent
+	if len(recorder.Deletions) != 1 {
+		t.Fatalf("expected the progress message to be deleted, got %+v", recorder.Deletions)
+	}
+}
+
+func TestInvoicesWithoutInvoices(t *testing.T) {
+	recorder := setupTestBot(t)
+	sendCommand("/invoices 2023-03")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "No invoices found for 2023-03" {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+	sendCommand("/invoices 2023-13")
+	if msg := lastMessage(t, recorder, testChatID); !strings.HasPrefix(msg.Text, "Error: invalid month") {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+	// only whitespace after the command
+	sendCommand("/invoices   ")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "Error: usage: /invoices [YYYY-MM]" {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+	pressButton("/invoices  ")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "Error: usage: /invoices [YYYY-MM]" {
+		t.Fatalf("unexpected reply: %q", msg.Text)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	recorder := setupTestBot(t)
+	sendCommand("/notifications")
+	msg := lastMessage(t, recorder, testChatID)
+	if !hasButton(msg, "/notifications yes") || !hasButton(msg, "/notifications no") {
+		t.Fatalf("expected yes/no buttons, got %+v", msg.Buttons)
+	}
+
+	pressButton("/notifications yes")
+	if !isNotifiedChat(testChatID) {
+		t.Fatal("chat should be notified")
+	}
+
+	// an invoice from a past month which wasn't sent to accounting yet
+	if _, err := processIncomingInvoice("faktura.pdf", readTestdata(t, "invoice_simple.pdf"), newTelegramInvoiceSource(&AuthorizedUser{TelegramID: testUserID})); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Reset()
+	doSendNotifications()
+	msg = lastMessage(t, recorder, testChatID)
+	if !strings.Contains(msg.Text, "invoices to send to accounting") || !hasButton(msg, "/invoices 2023-03") {
+		t.Fatalf("unexpected notification: %q %+v", msg.Text, msg.Buttons)
+	}
+
+	// nothing to nag about once the month is acknowledged
+	if err := acknowledgeMonth(2023, 3, "test"); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Reset()
+	doSendNotifications()
+	if len(recorder.Messages) != 0 {
+		t.Fatalf("expected no notifications, got %+v", recorder.Messages)
+	}
+
+	sendCommand("/notifications no")
+	if isNotifiedChat(testChatID) {
+		t.Fatal("chat should no longer be notified")
+	}
+}
+
+func TestAcknowledgeOlderMonthKeepsLaterOne(t *testing.T) {
+	setupTestBot(t)
+	pressButton("/notifications yes")
+	if err := acknowledgeMonth(2023, 3, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. a late /sendzip or a forwarded ZIP of an older month
+	if err := acknowledgeMonth(2023, 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	chat := &NotifiedChat{}
+	if err := db.First(chat).Error; err != nil {
+		t.Fatal(err)
+	}
+	if chat.LastAcknowledgedYear != 2023 || chat.LastAcknowledgedMonth != 3 {
+		t.Fatalf("the chat was rolled back to %04d-%02d", chat.LastAcknowledgedYear, chat.LastAcknowledgedMonth)
+	}
+}
+
+func TestEmailInvoiceNotification(t *testing.T) {
+	recorder := setupTestBot(t)
+	pressButton("/notifications yes")
+	recorder.Reset()
+
+	err := handleEmailAttachment(AttachmentToHandle{
+		SenderEmail: "billing@acme.example",
+		Subject:     "Invoice for March",
+		FileName:    "faktura.pdf",
+		MimeType:    "application/pdf",
+		Content:     readTestdata(t, "invoice_simple.pdf"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := lastMessage(t, recorder, testChatID)
+	if msg.ParseMode != "HTML" {
+		t.Fatalf("expected an HTML notification, got %q", msg.ParseMode)
+	}
+	for _, want := range []string{"Received e-mail invoice", "<b>faktura.pdf</b>", "<b>billing@acme.example</b>", "<b>success</b>", "Billing month: <b>2023-03</b>", "Gross: 1230.00 PLN"} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("notification %q doesn't contain %q", msg.Text, want)
+		}
+	}
+
+	// the same file again is reported, not stored twice
+	handleEmailAttachment(AttachmentToHandle{SenderEmail: "billing@acme.example", FileName: "faktura.pdf", MimeType: "application/pdf", Content: readTestdata(t, "invoice_simple.pdf")})
+	if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, ErrInvoiceExists.Error()) {
+		t.Fatalf("expected a duplicate notice, got %q", msg.Text)
+	}
+}
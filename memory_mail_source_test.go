@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+type memoryMailbox struct {
+	messages    []*memory.Message
+	uidNext     uint32
+	uidValidity uint32
+}
+
+// MemoryMailSource is an in-memory MailSource. It reuses go-imap's memory backend
+// messages, so fetched envelopes and body sections look like the ones a real
+// IMAP server returns.
+type MemoryMailSource struct {
+	mu        sync.Mutex
+	mailboxes map[string]*memoryMailbox
+	selected  string
+	// NoIdle makes the source behave like a server without the IDLE extension
+	NoIdle bool
+	// signalled when a message is added
+	newMail chan struct{}
+	// closed by Disconnect
+	disconnected     chan struct{}
+	disconnectedOnce sync.Once
+}
+
+func NewMemoryMailSource() *MemoryMailSource {
+	return &MemoryMailSource{
+		mailboxes: map[string]*memoryMailbox{
+			"INBOX": {uidNext: 1, uidValidity: 1},
+		},
+		newMail:      make(chan struct{}, 1),
+		disconnected: make(chan struct{}),
+	}
+}
+
+// Dial returns a function suitable for dialMailSource which connects every account to this source
+func (m *MemoryMailSource) Dial() func(*MailAccount) (MailSource, error) {
+	return func(*MailAccount) (MailSource, error) {
+		return m, nil
+	}
+}
+
+// AddMessage delivers a raw RFC 822 message to the given mailbox, creating it if needed
+func (m *MemoryMailSource) AddMessage(mailbox string, raw []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, ok := m.mailboxes[mailbox]
+	if !ok {
+		mbox = &memoryMailbox{uidNext: 1, uidValidity: 1}
+		m.mailboxes[mailbox] = mbox
+	}
+	mbox.messages = append(mbox.messages, &memory.Message{
+		Uid:   mbox.uidNext,
+		Date:  time.Now(),
+		Size:  uint32(len(raw)),
+		Flags: []string{},
+		Body:  raw,
+	})
+	mbox.uidNext++
+	select {
+	case m.newMail <- struct{}{}:
+	default:
+	}
+}
+
+// Messages returns the raw messages currently stored in the mailbox
+func (m *MemoryMailSource) Messages(mailbox string) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw := [][]byte{}
+	if mbox, ok := m.mailboxes[mailbox]; ok {
+		for _, msg := range mbox.messages {
+			raw = append(raw, msg.Body)
+		}
+	}
+	return raw
+}
+
+func (m *MemoryMailSource) ListMailboxes() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for name := range m.mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryMailSource) SelectMailbox(name string) (*imap.MailboxStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, ok := m.mailboxes[name]
+	if !ok {
+		return nil, fmt.Errorf("no such mailbox: %v", name)
+	}
+	m.selected = name
+	status := imap.NewMailboxStatus(name, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity})
+	status.Messages = uint32(len(mbox.messages))
+	status.UidNext = mbox.uidNext
+	status.UidValidity = mbox.uidValidity
+	return status, nil
+}
+
+func (m *MemoryMailSource) selectedMailbox() (*memoryMailbox, error) {
+	mbox, ok := m.mailboxes[m.selected]
+	if !ok {
+		return nil, fmt.Errorf("no mailbox selected")
+	}
+	return mbox, nil
+}
+
+// RenumberMailbox assigns new UIDs to every message of the mailbox and changes its
+// UIDVALIDITY, like a server does after the mailbox is recreated
+func (m *MemoryMailSource) RenumberMailbox(mailbox string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, ok := m.mailboxes[mailbox]
+	if !ok {
+		return
+	}
+	mbox.uidValidity++
+	mbox.uidNext = 1
+	for _, msg := range mbox.messages {
+		msg.Uid = mbox.uidNext
+		mbox.uidNext++
+	}
+}
+
+// findMessage returns the sequence number and message with the given UID
+func (mbox *memoryMailbox) findMessage(uid uint32) (uint32, *memory.Message, error) {
+	for i, msg := range mbox.messages {
+		if msg.Uid == uid {
+			return uint32(i + 1), msg, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no such message: %v", uid)
+}
+
+func (m *MemoryMailSource) UidFetch(uidset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, err := m.selectedMailbox()
+	if err != nil {
+		return nil, err
+	}
+	fetched := []*imap.Message{}
+	for i, msg := range mbox.messages {
+		seqNum := uint32(i + 1)
+		if !uidset.Contains(msg.Uid) {
+			continue
+		}
+		f, err := msg.Fetch(seqNum, items)
+		if err != nil {
+			return nil, err
+		}
+		fetched = append(fetched, f)
+	}
+	return fetched, nil
+}
+
+func (m *MemoryMailSource) AddFlag(uid uint32, flag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, err := m.selectedMailbox()
+	if err != nil {
+		return err
+	}
+	_, msg, err := mbox.findMessage(uid)
+	if err != nil {
+		return err
+	}
+	msg.Flags = backendutil.UpdateFlags(msg.Flags, imap.AddFlags, []string{flag})
+	return nil
+}
+
+// Flags returns the flags of the message with the given UID
+func (m *MemoryMailSource) Flags(mailbox string, uid uint32) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, ok := m.mailboxes[mailbox]
+	if !ok {
+		return nil
+	}
+	_, msg, err := mbox.findMessage(uid)
+	if err != nil {
+		return nil
+	}
+	return msg.Flags
+}
+
+func (m *MemoryMailSource) MoveMessage(uid uint32, mailbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, err := m.selectedMailbox()
+	if err != nil {
+		return err
+	}
+	dest, ok := m.mailboxes[mailbox]
+	if !ok {
+		return fmt.Errorf("no such mailbox: %v", mailbox)
+	}
+	seqNum, msg, err := mbox.findMessage(uid)
+	if err != nil {
+		return err
+	}
+	mbox.messages = append(mbox.messages[:seqNum-1], mbox.messages[seqNum:]...)
+	msg.Uid = dest.uidNext
+	dest.uidNext++
+	dest.messages = append(dest.messages, msg)
+	return nil
+}
+
+func (m *MemoryMailSource) CreateMailbox(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.mailboxes[name]; ok {
+		return fmt.Errorf("mailbox already exists: %v", name)
+	}
+	m.mailboxes[name] = &memoryMailbox{uidNext: 1, uidValidity: 1}
+	return nil
+}
+
+func (m *MemoryMailSource) Expunge() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mbox, err := m.selectedMailbox()
+	if err != nil {
+		return err
+	}
+	kept := []*memory.Message{}
+	for _, msg := range mbox.messages {
+		deleted := false
+		for _, flag := range msg.Flags {
+			if flag == imap.DeletedFlag {
+				deleted = true
+			}
+		}
+		if !deleted {
+			kept = append(kept, msg)
+		}
+	}
+	mbox.messages = kept
+	return nil
+}
+
+func (m *MemoryMailSource) SupportsIdle() (bool, error) {
+	return !m.NoIdle, nil
+}
+
+func (m *MemoryMailSource) WaitForNewMail(timeout time.Duration) error {
+	if m.NoIdle {
+		return fmt.Errorf("IDLE is not supported")
+	}
+	select {
+	case <-m.newMail:
+	case <-m.disconnected:
+		return fmt.Errorf("connection closed")
+	case <-time.After(timeout):
+	}
+	return nil
+}
+
+// Disconnect makes the waits for new mail fail, like a broken connection
+func (m *MemoryMailSource) Disconnect() {
+	m.disconnectedOnce.Do(func() { close(m.disconnected) })
+}
+
+func (m *MemoryMailSource) Close() error {
+	return nil
+}
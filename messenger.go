@@ -0,0 +1,49 @@
+package main
+
+// MessageButton is a single inline keyboard button. Data is sent back to the bot
+// as a callback query when the button is pressed.
+type MessageButton struct {
+	Text string
+	Data string
+}
+
+type OutgoingMessage struct {
+	ChatID           int64
+	Text             string
+	ParseMode        string
+	ReplyToMessageID int
+	// Buttons is rendered as an inline keyboard, one slice per row
+	Buttons [][]MessageButton
+}
+
+type OutgoingDocument struct {
+	FileName string
+	Contents []byte
+	// Path, when set, is a file on disk to send instead of Contents
+	Path string
+}
+
+// Messenger is everything the bot needs from the chat platform. The production
+// implementation talks to Telegram, the tests use RecordingMessenger.
+type Messenger interface {
+	// SendText sends a message and returns its ID
+	SendText(msg OutgoingMessage) (int, error)
+	// EditText replaces the text and buttons of a message sent earlier
+	EditText(messageID int, msg OutgoingMessage) error
+	SendDocuments(chatID int64, replyToMessageID int, docs []OutgoingDocument) error
+	DeleteMessage(chatID int64, messageID int) error
+	AnswerCallback(callbackID string, text string) error
+	// DownloadFile fetches a file the user has sent to the bot
+	DownloadFile(fileID string) ([]byte, error)
+}
+
+var messenger Messenger
+
+// replyText sends a plain text reply to the given message
+func replyText(chatID int64, messageID int, text string) {
+	messenger.SendText(OutgoingMessage{
+		ChatID:           chatID,
+		Text:             text,
+		ReplyToMessageID: messageID,
+	})
+}
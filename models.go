@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -8,8 +10,11 @@ import (
 
 type AuthorizedUser struct {
 	gorm.Model
-	TelegramID int64
+	TelegramID int64 `gorm:"uniqueIndex"`
 	UserName   string
+	Role       string
+	// telegram ID of the admin whose invite was redeemed, 0 for the bootstrap admin
+	InvitedBy int64
 }
 
 type NotifiedChat struct {
@@ -24,8 +29,115 @@ type NotifiedChat struct {
 type Invoice struct {
 	gorm.Model
 	FileName string
-	Contents []byte `gorm:"type:blob"`
-	Sha256   string
+	// Sha256 is also the key of the invoice contents in the blob store
+	Sha256 string
+	// the month the invoice is accounted for, defaults to the upload month
+	BillingYear  int `gorm:"index:idx_invoices_billing_period"`
+	BillingMonth int `gorm:"index:idx_invoices_billing_period"`
+
+	// metadata extracted from the invoice text, amounts are in hundredths of the currency
+	InvoiceNumber string
+	SellerNIP     string `gorm:"column:seller_nip"`
+	IssueDate     *time.Time
+	NetAmount     *int64
+	VatAmount     *int64
+	GrossAmount   *int64
+	Currency      string
+
+	// nil for invoices stored before sources were recorded
+	Source *InvoiceSource
+
+	// hash of the normalized text, see normalizedTextSha256
+	TextSha256 string `gorm:"index"`
+	// set while the invoice looks like a duplicate of another one and nobody decided what to do with it
+	DuplicateOfID *uint
+}
+
+func (i Invoice) BillingPeriod() string {
+	return fmt.Sprintf("%04d-%02d", i.BillingYear, i.BillingMonth)
+}
+
+func (i *Invoice) SetMetadata(meta InvoiceMetadata) {
+	i.InvoiceNumber = meta.Number
+	i.SellerNIP = meta.SellerNIP
+	i.IssueDate = meta.IssueDate
+	i.NetAmount = meta.NetAmount
+	i.VatAmount = meta.VatAmount
+	i.GrossAmount = meta.GrossAmount
+	i.Currency = meta.Currency
+}
+
+// MetadataSummary lists the extracted metadata, one field per line
+func (i Invoice) MetadataSummary() string {
+	lines := []string{}
+	if i.InvoiceNumber != "" {
+		lines = append(lines, "Number: "+i.InvoiceNumber)
+	}
+	if i.SellerNIP != "" {
+		lines = append(lines, "Seller NIP: "+i.SellerNIP)
+	}
+	if i.IssueDate != nil {
+		lines = append(lines, "Issue date: "+i.IssueDate.Format("2006-01-02"))
+	}
+	if i.NetAmount != nil {
+		lines = append(lines, "Net: "+formatAmount(*i.NetAmount, i.Currency))
+	}
+	if i.VatAmount != nil {
+		lines = append(lines, "VAT: "+formatAmount(*i.VatAmount, i.Currency))
+	}
+	if i.GrossAmount != nil {
+		lines = append(lines, "Gross: "+formatAmount(*i.GrossAmount, i.Currency))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func migrateDatabase() error {
+	if err := dedupeAuthorizedUsers(); err != nil {
+		return fmt.Errorf("failed to remove duplicate users: %v", err)
+	}
+	err := db.AutoMigrate(&AuthorizedUser{}, &Invoice{}, &InvoiceSource{}, &NotifiedChat{}, &GeneratedZip{}, &ApiToken{}, &InviteCode{}, &AuditEvent{}, &MailboxState{}, &OAuth2Token{})
+	if err != nil {
+		return err
+	}
+	// users authorized before roles were introduced could do everything
+	if err := db.Exec("UPDATE authorized_users SET role = ? WHERE role IS NULL OR role = ''", RoleAdmin).Error; err != nil {
+		return fmt.Errorf("failed to set user roles: %v", err)
+	}
+	if err := migrateInvoiceBlobs(); err != nil {
+		return fmt.Errorf("failed to migrate invoice blobs: %v", err)
+	}
+	if err := migrateInvoiceSearch(); err != nil {
+		return fmt.Errorf("failed to set up invoice search: %v", err)
+	}
+	if err := backfillTextHashes(); err != nil {
+		return fmt.Errorf("failed to compute invoice text hashes: %v", err)
+	}
+	// invoices uploaded before billing periods were introduced are billed in their upload month
+	err = db.Exec("UPDATE invoices SET billing_year = CAST(strftime('%Y', created_at) AS INTEGER), billing_month = CAST(strftime('%m', created_at) AS INTEGER) WHERE billing_year IS NULL OR billing_year = 0").Error
+	if err != nil {
+		return fmt.Errorf("failed to set billing periods: %v", err)
+	}
+	return nil
+}
+
+// ApiToken authenticates a client of the JSON API, only the hash of the token is stored
+type ApiToken struct {
+	gorm.Model
+	Name       string
+	TokenHash  string `gorm:"uniqueIndex"`
+	CreatedBy  int64
+	LastUsedAt *time.Time
+}
+
+// MailboxState remembers which messages of a mailbox were already handled
+type MailboxState struct {
+	gorm.Model
+	// the DisplayName of the MailAccount
+	Account     string `gorm:"uniqueIndex:idx_mailbox_states_account_mailbox"`
+	Mailbox     string `gorm:"uniqueIndex:idx_mailbox_states_account_mailbox"`
+	UidValidity uint32
+	// UID of the last handled message, only larger UIDs are new
+	LastUid uint32
 }
 
 type GeneratedZip struct {
@@ -34,4 +146,7 @@ type GeneratedZip struct {
 	Sha256   string `gorm:"unique"`
 	Month    int
 	Year     int
+	// set once the ZIP was e-mailed to accounting, it is never sent twice
+	SentToAccountingAt *time.Time
+	SentTo             string
 }
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"log"
 	"time"
-
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type MonthToNotify struct {
@@ -29,7 +27,7 @@ func doSendNotifications() {
 		log.Printf("error getting notified chats: %v", err)
 		return
 	}
-	rows, err := db.Raw("SELECT strftime('%Y', created_at) as year, strftime('%m', created_at) as month, COUNT(*) as count FROM invoices GROUP BY year, month ORDER BY year DESC, month DESC").Rows()
+	rows, err := db.Raw("SELECT billing_year as year, billing_month as month, COUNT(*) as count FROM invoices WHERE deleted_at IS NULL GROUP BY year, month ORDER BY year DESC, month DESC").Rows()
 	if err != nil {
 		log.Printf("error getting months to notify: %v", err)
 		return
@@ -60,29 +58,60 @@ func doSendNotifications() {
 			continue
 		}
 		// send notifications
-		msg := tgbotapi.NewMessage(notifiedChat.TelegramChatID, "❗ You have invoices to send to accounting for the following months:")
-		keyboard := tgbotapi.NewInlineKeyboardMarkup()
+		msg := OutgoingMessage{
+			ChatID: notifiedChat.TelegramChatID,
+			Text:   "❗ You have invoices to send to accounting for the following months:",
+		}
 		for _, monthToNotify := range monthsToNotifyToSend {
-			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(monthToNotify.String(), "/invoices "+monthToNotify.String())))
+			msg.Buttons = append(msg.Buttons, []MessageButton{{Text: monthToNotify.String(), Data: "/invoices " + monthToNotify.String()}})
 		}
-		msg.ReplyMarkup = keyboard
-		if _, err := bot.Send(msg); err != nil {
+		if _, err := messenger.SendText(msg); err != nil {
 			log.Printf("error sending notification to chat %v: %v", notifiedChat.TelegramChatID, err)
 		}
 
 	}
 }
 
+// acknowledgeMonth marks the month as sent to accounting for every notified chat
+// which hasn't acknowledged it or a later month yet, an older month never rolls a chat back
+func acknowledgeMonth(year int, month int, actor string) error {
+	err := db.Model(&NotifiedChat{}).
+		Where("last_acknowledged_year < ? OR (last_acknowledged_year = ? AND last_acknowledged_month < ?)", year, year, month).
+		Updates(NotifiedChat{
+			LastAcknowledgedMonth: month,
+			LastAcknowledgedYear:  year,
+		}).Error
+	if err != nil {
+		return err
+	}
+	recordAuditEvent(actor, AuditMonthAcknowledged, 0, fmt.Sprintf("%04d-%02d", year, month))
+	return nil
+}
+
+func isNotifiedChat(chatID int64) bool {
+	var count int64
+	db.Model(&NotifiedChat{}).Where("telegram_chat_id = ?", chatID).Count(&count)
+	return count > 0
+}
+
 func notifyAllChats(contents string) {
+	notifyAllChatsWithButtons(contents, nil)
+}
+
+func notifyAllChatsWithButtons(contents string, buttons [][]MessageButton) {
 	notifiedChats := []NotifiedChat{}
 	if err := db.Find(&notifiedChats).Error; err != nil {
 		log.Printf("error getting notified chats: %v", err)
 		return
 	}
 	for _, notifiedChat := range notifiedChats {
-		msg := tgbotapi.NewMessage(notifiedChat.TelegramChatID, contents)
-		msg.ParseMode = "HTML"
-		if _, err := bot.Send(msg); err != nil {
+		msg := OutgoingMessage{
+			ChatID:    notifiedChat.TelegramChatID,
+			Text:      contents,
+			ParseMode: "HTML",
+			Buttons:   buttons,
+		}
+		if _, err := messenger.SendText(msg); err != nil {
 			log.Printf("error sending notification to chat %v: %v", notifiedChat.TelegramChatID, err)
 		}
 	}
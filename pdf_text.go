@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// A minimal PDF text extractor. It only understands what is needed to get the
+// text out of typical generated invoices: FlateDecode streams, object streams,
+// page content streams and ToUnicode CMaps. Layout is approximated by breaking
+// lines whenever the text position moves vertically.
+
+var (
+	pdfObjRegex          = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfRefRegex          = regexp.MustCompile(`(\d+)\s+\d+\s+R\b`)
+	pdfFontDictRegex     = regexp.MustCompile(`(?s)/Font\s*<<(.*?)>>`)
+	pdfFontRefRegex      = regexp.MustCompile(`/Font\s+(\d+)\s+\d+\s+R\b`)
+	pdfNamedRefRegex     = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R\b`)
+	pdfToUnicodeRegex    = regexp.MustCompile(`/ToUnicode\s+(\d+)\s+\d+\s+R\b`)
+	pdfContentsRefRegex  = regexp.MustCompile(`/Contents\s+(\d+)\s+\d+\s+R\b`)
+	pdfContentsArrRegex  = regexp.MustCompile(`(?s)/Contents\s*\[(.*?)\]`)
+	pdfPageTypeRegex     = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfObjStmTypeRegex   = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfIntEntryRegex     = regexp.MustCompile(`/(N|First|Length)\s+(\d+)(\s+\d+\s+R\b)?`)
+	pdfStreamStartRegex  = regexp.MustCompile(`>>\s*stream(\r\n|\n|\r)?`)
+	pdfCmapBfcharRegex   = regexp.MustCompile(`(?s)beginbfchar(.*?)endbfchar`)
+	pdfCmapBfrangeRegex  = regexp.MustCompile(`(?s)beginbfrange(.*?)endbfrange`)
+	pdfCmapHexRegex      = regexp.MustCompile(`<([0-9A-Fa-f\s]*)>|\[|\]`)
+	pdfUnsupportedFilter = regexp.MustCompile(`/(DCTDecode|JPXDecode|CCITTFaxDecode|JBIG2Decode|LZWDecode|RunLengthDecode|ASCII85Decode|ASCIIHexDecode)`)
+)
+
+// a ToUnicode CMap maps at most this many codes, which is more than any 2-byte font has
+const maxPdfCMapSize = 1 << 17
+
+// the streams of a single PDF are inflated up to this many bytes in total, so a
+// small crafted file can't make the bot allocate gigabytes
+const maxPdfDecodedSize = 32 << 20
+
+type pdfObject struct {
+	dict   string
+	stream []byte
+}
+
+type pdfCMap struct {
+	codeBytes int
+	runes     map[uint32]string
+}
+
+// extractPdfText returns the text of all pages of a PDF, page by page.
+func extractPdfText(data []byte) (_ string, err error) {
+	// a malformed file mustn't take the bot down, whatever the parser missed
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \r\n\t"), []byte("%PDF")) {
+		return "", errors.New("not a PDF file")
+	}
+	objects := parsePdfObjects(data)
+	fonts := pdfFonts(objects)
+
+	// page objects are visited in object number order, which is the page order for most generators
+	objNums := []int{}
+	for num := range objects {
+		objNums = append(objNums, num)
+	}
+	sort.Ints(objNums)
+	contentStreams := [][]byte{}
+	for _, num := range objNums {
+		obj := objects[num]
+		if !pdfPageTypeRegex.MatchString(obj.dict) {
+			continue
+		}
+		refs := []string{}
+		if m := pdfContentsRefRegex.FindStringSubmatch(obj.dict); m != nil {
+			refs = append(refs, m[1])
+		} else if m := pdfContentsArrRegex.FindStringSubmatch(obj.dict); m != nil {
+			for _, ref := range pdfRefRegex.FindAllStringSubmatch(m[1], -1) {
+				refs = append(refs, ref[1])
+			}
+		}
+		page := []byte{}
+		for _, ref := range refs {
+			refNum, _ := strconv.Atoi(ref)
+			if content, ok := objects[refNum]; ok {
+				page = append(page, content.stream...)
+				page = append(page, '\n')
+			}
+		}
+		contentStreams = append(contentStreams, page)
+	}
+	if len(contentStreams) == 0 {
+		return "", errors.New("no pages found in PDF")
+	}
+
+	text := &strings.Builder{}
+	for _, content := range contentStreams {
+		extractPdfContentText(content, fonts, text)
+		text.WriteString("\n")
+	}
+	// tidy up whitespace left behind by the layout heuristics
+	lines := strings.Split(text.String(), "\n")
+	result := []string{}
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return strings.Join(result, "\n"), nil
+}
+
+func parsePdfObjects(data []byte) map[int]*pdfObject {
+	objects := map[int]*pdfObject{}
+	budget := maxPdfDecodedSize
+	locs := pdfObjRegex.FindAllSubmatchIndex(data, -1)
+	for i, loc := range locs {
+		num, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		end := len(data)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		body := data[loc[1]:end]
+		if idx := bytes.Index(body, []byte("endobj")); idx >= 0 {
+			body = body[:idx]
+		}
+		obj := &pdfObject{dict: string(body)}
+		if loc := pdfStreamStartRegex.FindIndex(body); loc != nil {
+			obj.dict = string(body[:loc[0]+2])
+			raw := body[loc[1]:]
+			if end := bytes.LastIndex(raw, []byte("endstream")); end >= 0 {
+				raw = raw[:end]
+			}
+			obj.stream = decodePdfStream(obj.dict, raw, &budget)
+		}
+		// later definitions of an object override earlier ones (incremental updates)
+		objects[num] = obj
+	}
+	// objects stored inside compressed object streams
+	for _, obj := range objects {
+		if obj.stream == nil || !pdfObjStmTypeRegex.MatchString(obj.dict) {
+			continue
+		}
+		n, first := pdfIntEntry(obj.dict, "N"), pdfIntEntry(obj.dict, "First")
+		if first <= 0 || first > len(obj.stream) {
+			continue
+		}
+		header := strings.Fields(string(obj.stream[:first]))
+		for i := 0; i+1 < len(header) && i/2 < n; i += 2 {
+			num, err1 := strconv.Atoi(header[i])
+			offset, err2 := strconv.Atoi(header[i+1])
+			// offsets come from the file, so they may point anywhere
+			if err1 != nil || err2 != nil || offset < 0 || offset > len(obj.stream)-first {
+				break
+			}
+			end := len(obj.stream)
+			if i+3 < len(header) {
+				if next, err := strconv.Atoi(header[i+3]); err == nil && next >= offset && next <= end-first {
+					end = first + next
+				}
+			}
+			if _, ok := objects[num]; !ok {
+				objects[num] = &pdfObject{dict: string(obj.stream[first+offset : end])}
+			}
+		}
+	}
+	return objects
+}
+
+func pdfIntEntry(dict string, key string) int {
+	for _, m := range pdfIntEntryRegex.FindAllStringSubmatch(dict, -1) {
+		// indirect values ("/Length 12 0 R") are not resolved
+		if m[1] == key && m[3] == "" {
+			v, _ := strconv.Atoi(m[2])
+			return v
+		}
+	}
+	return 0
+}
+
+// decodePdfStream returns the contents of a stream, inflating at most budget bytes
+// and subtracting what was inflated from it
+func decodePdfStream(dict string, raw []byte, budget *int) []byte {
+	if length := pdfIntEntry(dict, "Length"); length > 0 && length <= len(raw) {
+		raw = raw[:length]
+	}
+	if pdfUnsupportedFilter.MatchString(dict) {
+		return nil
+	}
+	if !strings.Contains(dict, "/FlateDecode") {
+		return raw
+	}
+	if *budget <= 0 {
+		return nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	// truncated streams are common, keep whatever could be inflated
+	decoded, _ := ioutil.ReadAll(io.LimitReader(r, int64(*budget)))
+	*budget -= len(decoded)
+	return decoded
+}
+
+// pdfFonts maps font resource names (e.g. F1) to the ToUnicode CMap of the font
+func pdfFonts(objects map[int]*pdfObject) map[string]*pdfCMap {
+	fonts := map[string]*pdfCMap{}
+	// fonts often share a CMap, it is parsed once
+	cmaps := map[int]*pdfCMap{}
+	addFonts := func(fontDict string) {
+		for _, m := range pdfNamedRefRegex.FindAllStringSubmatch(fontDict, -1) {
+			if _, ok := fonts[m[1]]; ok {
+				continue
+			}
+			fontNum, _ := strconv.Atoi(m[2])
+			font, ok := objects[fontNum]
+			if !ok {
+				continue
+			}
+			var cmap *pdfCMap
+			if tu := pdfToUnicodeRegex.FindStringSubmatch(font.dict); tu != nil {
+				cmapNum, _ := strconv.Atoi(tu[1])
+				if parsed, ok := cmaps[cmapNum]; ok {
+					cmap = parsed
+				} else if cmapObj, ok := objects[cmapNum]; ok {
+					cmap = parsePdfCMap(cmapObj.stream)
+					cmaps[cmapNum] = cmap
+				}
+			}
+			fonts[m[1]] = cmap
+		}
+	}
+	for _, obj := range objects {
+		for _, m := range pdfFontDictRegex.FindAllStringSubmatch(obj.dict, -1) {
+			addFonts(m[1])
+		}
+		for _, m := range pdfFontRefRegex.FindAllStringSubmatch(obj.dict, -1) {
+			num, _ := strconv.Atoi(m[1])
+			if fontDict, ok := objects[num]; ok {
+				addFonts(fontDict.dict)
+			}
+		}
+	}
+	return fonts
+}
+
+func parsePdfCMap(data []byte) *pdfCMap {
+	if data == nil {
+		return nil
+	}
+	cmap := &pdfCMap{codeBytes: 1, runes: map[uint32]string{}}
+	hexValue := func(s string) (uint32, int, error) {
+		s = strings.Join(strings.Fields(s), "")
+		v, err := strconv.ParseUint(s, 16, 32)
+		return uint32(v), len(s) / 2, err
+	}
+	// counts every mapping, also overwritten ones, to bound the work on crafted CMaps
+	mapped := 0
+	set := func(code uint32, s string) bool {
+		if mapped >= maxPdfCMapSize {
+			return false
+		}
+		mapped++
+		cmap.runes[code] = s
+		return true
+	}
+	for _, section := range pdfCmapBfcharRegex.FindAllSubmatch(data, -1) {
+		tokens := pdfCmapHexRegex.FindAllStringSubmatch(string(section[1]), -1)
+		for i := 0; i+1 < len(tokens); i += 2 {
+			code, size, err := hexValue(tokens[i][1])
+			if err != nil {
+				continue
+			}
+			if size > cmap.codeBytes {
+				cmap.codeBytes = size
+			}
+			set(code, decodeUTF16Hex(tokens[i+1][1]))
+		}
+	}
+	for _, section := range pdfCmapBfrangeRegex.FindAllSubmatch(data, -1) {
+		tokens := pdfCmapHexRegex.FindAllStringSubmatch(string(section[1]), -1)
+		for i := 0; i+2 < len(tokens); {
+			lo, size, errLo := hexValue(tokens[i][1])
+			hi, _, errHi := hexValue(tokens[i+1][1])
+			// the rest of a malformed section is ignored
+			if errLo != nil || errHi != nil || hi < lo || hi-lo > 0xffff {
+				break
+			}
+			if size > cmap.codeBytes {
+				cmap.codeBytes = size
+			}
+			if tokens[i+2][0] == "[" {
+				i += 3
+				for code := lo; i < len(tokens) && tokens[i][0] != "]"; i, code = i+1, code+1 {
+					set(code, decodeUTF16Hex(tokens[i][1]))
+				}
+				i++
+				continue
+			}
+			dst := []rune(decodeUTF16Hex(tokens[i+2][1]))
+			// counting the offset can't wrap around when hi is 0xFFFFFFFF
+			for off := uint32(0); off <= hi-lo && len(dst) > 0; off++ {
+				last := len(dst) - 1
+				if !set(lo+off, string(dst[:last])+string(dst[last]+rune(off))) {
+					break
+				}
+			}
+			i += 3
+		}
+	}
+	return cmap
+}
+
+func decodeUTF16Hex(s string) string {
+	s = strings.Join(strings.Fields(s), "")
+	units := []uint16{}
+	for i := 0; i+4 <= len(s); i += 4 {
+		v, err := strconv.ParseUint(s[i:i+4], 16, 16)
+		if err != nil {
+			return ""
+		}
+		units = append(units, uint16(v))
+	}
+	if len(s) == 2 {
+		v, _ := strconv.ParseUint(s, 16, 8)
+		units = append(units, uint16(v))
+	}
+	return string(utf16.Decode(units))
+}
+
+func (c *pdfCMap) decode(s []byte) string {
+	if c == nil {
+		// no ToUnicode map, assume a latin-1 compatible simple font encoding
+		runes := make([]rune, len(s))
+		for i, b := range s {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	out := &strings.Builder{}
+	for i := 0; i+c.codeBytes <= len(s); i += c.codeBytes {
+		var code uint32
+		for _, b := range s[i : i+c.codeBytes] {
+			code = code<<8 | uint32(b)
+		}
+		out.WriteString(c.runes[code])
+	}
+	return out.String()
+}
+
+type pdfOperand struct {
+	str    []byte
+	isStr  bool
+	num    float64
+	isNum  bool
+	name   string
+	isName bool
+	arr    []pdfOperand
+}
+
+func extractPdfContentText(content []byte, fonts map[string]*pdfCMap, out *strings.Builder) {
+	var font *pdfCMap
+	operands := []pdfOperand{}
+	var arrayStack [][]pdfOperand
+	lastY := 0.0
+	push := func(op pdfOperand) {
+		if len(arrayStack) > 0 {
+			arrayStack[len(arrayStack)-1] = append(arrayStack[len(arrayStack)-1], op)
+			return
+		}
+		operands = append(operands, op)
+	}
+	i := 0
+	for i < len(content) {
+		c := content[i]
+		switch {
+		case c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0:
+			i++
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			var s []byte
+			s, i = readPdfLiteralString(content, i)
+			push(pdfOperand{str: s, isStr: true})
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			i += 2
+		case c == '>' && i+1 < len(content) && content[i+1] == '>':
+			i += 2
+		case c == '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			hex := strings.Join(strings.Fields(string(content[i+1:i+end])), "")
+			if len(hex)%2 == 1 {
+				hex += "0"
+			}
+			s := make([]byte, len(hex)/2)
+			for j := range s {
+				v, _ := strconv.ParseUint(hex[j*2:j*2+2], 16, 8)
+				s[j] = byte(v)
+			}
+			push(pdfOperand{str: s, isStr: true})
+			i += end + 1
+		case c == '[':
+			arrayStack = append(arrayStack, []pdfOperand{})
+			i++
+		case c == ']':
+			if len(arrayStack) > 0 {
+				arr := arrayStack[len(arrayStack)-1]
+				arrayStack = arrayStack[:len(arrayStack)-1]
+				push(pdfOperand{arr: arr})
+			}
+			i++
+		case c == '/':
+			start := i + 1
+			i++
+			for i < len(content) && !isPdfDelimiter(content[i]) {
+				i++
+			}
+			push(pdfOperand{name: string(content[start:i]), isName: true})
+		case (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.':
+			start := i
+			i++
+			for i < len(content) && ((content[i] >= '0' && content[i] <= '9') || content[i] == '.') {
+				i++
+			}
+			v, _ := strconv.ParseFloat(string(content[start:i]), 64)
+			push(pdfOperand{num: v, isNum: true})
+		default:
+			start := i
+			for i < len(content) && !isPdfDelimiter(content[i]) {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			op := string(content[start:i])
+			switch op {
+			case "Tf":
+				if len(operands) >= 2 && operands[len(operands)-2].isName {
+					font = fonts[operands[len(operands)-2].name]
+				}
+			case "Tj":
+				if len(operands) >= 1 && operands[len(operands)-1].isStr {
+					out.WriteString(font.decode(operands[len(operands)-1].str))
+				}
+			case "'", "\"":
+				out.WriteString("\n")
+				if len(operands) >= 1 && operands[len(operands)-1].isStr {
+					out.WriteString(font.decode(operands[len(operands)-1].str))
+				}
+			case "TJ":
+				if len(operands) >= 1 {
+					for _, el := range operands[len(operands)-1].arr {
+						if el.isStr {
+							out.WriteString(font.decode(el.str))
+						} else if el.isNum && el.num < -200 {
+							// a large negative adjustment is how many generators render spaces
+							out.WriteString(" ")
+						}
+					}
+				}
+			case "Td", "TD":
+				if len(operands) >= 2 && operands[len(operands)-1].num != 0 {
+					out.WriteString("\n")
+				} else {
+					out.WriteString(" ")
+				}
+			case "Tm":
+				if len(operands) >= 6 {
+					y := operands[len(operands)-1].num
+					if y != lastY {
+						out.WriteString("\n")
+					} else {
+						out.WriteString(" ")
+					}
+					lastY = y
+				}
+			case "T*":
+				out.WriteString("\n")
+			case "ET":
+				out.WriteString(" ")
+			case "ID":
+				// skip inline image data
+				end := bytes.Index(content[i:], []byte("EI"))
+				if end < 0 {
+					return
+				}
+				i += end + 2
+			}
+			operands = operands[:0]
+			arrayStack = nil
+		}
+	}
+}
+
+func isPdfDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\n', '\r', '\t', '\f', 0, '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// readPdfLiteralString reads a (string) starting at content[start], returning
+// the decoded bytes and the index after the closing parenthesis
+func readPdfLiteralString(content []byte, start int) ([]byte, int) {
+	out := []byte{}
+	depth := 0
+	i := start
+	for i < len(content) {
+		c := content[i]
+		switch c {
+		case '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+			i++
+		case ')':
+			depth--
+			i++
+			if depth == 0 {
+				return out, i
+			}
+			out = append(out, c)
+		case '\\':
+			i++
+			if i >= len(content) {
+				return out, i
+			}
+			e := content[i]
+			switch e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r':
+				if i+1 < len(content) && content[i+1] == '\n' {
+					i++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					j := 0
+					for ; j < 3 && i+j < len(content) && content[i+j] >= '0' && content[i+j] <= '7'; j++ {
+						v = v*8 + int(content[i+j]-'0')
+					}
+					out = append(out, byte(v))
+					i += j
+					continue
+				}
+				out = append(out, e)
+			}
+			i++
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+	return out, i
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPdf builds a PDF with one page showing content with the font F1, which is mapped
+// to Unicode with cmap. Streams are stored uncompressed.
+func testPdf(content string, cmap string) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type0 /ToUnicode 6 0 R >>",
+		fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", len(cmap), cmap),
+	}
+	b := &bytes.Buffer{}
+	b.WriteString("%PDF-1.4\n")
+	for i, obj := range objects {
+		fmt.Fprintf(b, "%v 0 obj\n%v\nendobj\n", i+1, obj)
+	}
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return b.Bytes()
+}
+
+func zlibCompress(t testing.TB, data []byte) []byte {
+	t.Helper()
+	b := &bytes.Buffer{}
+	w := zlib.NewWriter(b)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestExtractPdfText(t *testing.T) {
+	tests := []struct {
+		file string
+		want []string
+	}{
+		{"invoice_simple.pdf", []string{
+			"Faktura VAT nr FV/12/03/2023",
+			"Data wystawienia: 2023-03-31",
+			"Razem: 1 000,00 230,00 1 230,00",
+			"Do zaplaty: 1 230,00 PLN",
+		}},
+		// object streams, FlateDecode and a ToUnicode CMap with Polish letters
+		{"invoice_cid.pdf", []string{
+			"Faktura nr 2023/04/0007",
+			"Data wystawienia: 5 kwietnia 2023",
+			"Żółta Gęś sp. z o.o.",
+			"Do zapłaty: 3.075,00 zł",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			text, err := extractPdfText(readTestdata(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := map[string]bool{}
+			for _, line := range strings.Split(text, "\n") {
+				lines[line] = true
+			}
+			for _, want := range tt.want {
+				if !lines[want] {
+					t.Errorf("line %q missing from %q", want, text)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractPdfTextErrors(t *testing.T) {
+	if _, err := extractPdfText([]byte("GIF89a")); err == nil {
+		t.Error("expected an error for a file which isn't a PDF")
+	}
+	if _, err := extractPdfText([]byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")); err == nil {
+		t.Error("expected an error for a PDF without pages")
+	}
+}
+
+func TestParsePdfCMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmap      string
+		codeBytes int
+		want      map[uint32]string
+		size      int
+	}{
+		{
+			name:      "bfchar",
+			cmap:      "2 beginbfchar <01> <0041> <02> <017B> endbfchar",
+			codeBytes: 1,
+			want:      map[uint32]string{1: "A", 2: "Ż"},
+			size:      2,
+		},
+		{
+			name:      "two byte codes",
+			cmap:      "1 beginbfchar <0003> <0020> endbfchar",
+			codeBytes: 2,
+			want:      map[uint32]string{3: " "},
+			size:      1,
+		},
+		{
+			name:      "incrementing bfrange",
+			cmap:      "1 beginbfrange <0010> <0012> <0061> endbfrange",
+			codeBytes: 2,
+			want:      map[uint32]string{0x10: "a", 0x11: "b", 0x12: "c"},
+			size:      3,
+		},
+		{
+			name:      "bfrange with an array",
+			cmap:      "1 beginbfrange <01> <02> [<0066 0069> <00F3>] endbfrange",
+			codeBytes: 1,
+			want:      map[uint32]string{1: "fi", 2: "ó"},
+			size:      2,
+		},
+		{
+			name:      "range ending at the largest code",
+			cmap:      "1 beginbfrange <FFFFFFF0> <FFFFFFFF> <0041> endbfrange",
+			codeBytes: 4,
+			want:      map[uint32]string{0xFFFFFFF0: "A", 0xFFFFFFFF: "P"},
+			size:      16,
+		},
+		{
+			name:      "overlong codes are malformed",
+			cmap:      "1 beginbfchar <0102030405> <0041> endbfchar 1 beginbfrange <00> <0102030405> <0041> endbfrange",
+			codeBytes: 1,
+			want:      map[uint32]string{},
+			size:      0,
+		},
+		{
+			name:      "reversed range",
+			cmap:      "1 beginbfrange <20> <10> <0041> endbfrange",
+			codeBytes: 1,
+			want:      map[uint32]string{},
+			size:      0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmap := parsePdfCMap([]byte(tt.cmap))
+			if cmap.codeBytes != tt.codeBytes {
+				t.Errorf("codeBytes = %v, want %v", cmap.codeBytes, tt.codeBytes)
+			}
+			if len(cmap.runes) != tt.size {
+				t.Errorf("mapped %v codes, want %v", len(cmap.runes), tt.size)
+			}
+			for code, want := range tt.want {
+				if got := cmap.runes[code]; got != want {
+					t.Errorf("code %x = %q, want %q", code, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePdfCMapLimitsWork(t *testing.T) {
+	// every range covers 65536 codes, together far more than any font has
+	ranges := &strings.Builder{}
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(ranges, "<%04X0000> <%04XFFFF> <0041>\n", i, i)
+	}
+	cmap := parsePdfCMap([]byte("100 beginbfrange\n" + ranges.String() + "endbfrange"))
+	if len(cmap.runes) > maxPdfCMapSize {
+		t.Fatalf("mapped %v codes, the limit is %v", len(cmap.runes), maxPdfCMapSize)
+	}
+}
+
+func TestExtractPdfTextWithRangeEndingAtLargestCode(t *testing.T) {
+	pdf := testPdf("BT /F1 12 Tf <FFFFFFF0FFFFFFF1> Tj ET", "1 beginbfrange <FFFFFFF0> <FFFFFFFF> <0041> endbfrange")
+	done := make(chan string, 1)
+	go func() {
+		text, _ := extractPdfText(pdf)
+		done <- text
+	}()
+	select {
+	case text := <-done:
+		if text != "AB" {
+			t.Fatalf("unexpected text: %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extractPdfText didn't finish")
+	}
+}
+
+func TestDecodePdfStreamBudget(t *testing.T) {
+	compressed := zlibCompress(t, make([]byte, 4<<20))
+	dict := fmt.Sprintf("<< /Filter /FlateDecode /Length %v >>", len(compressed))
+	budget := 1 << 20
+	if decoded := decodePdfStream(dict, compressed, &budget); len(decoded) != 1<<20 {
+		t.Fatalf("decoded %v bytes, expected the budget of %v", len(decoded), 1<<20)
+	}
+	if budget != 0 {
+		t.Fatalf("budget left: %v", budget)
+	}
+	if decoded := decodePdfStream(dict, compressed, &budget); decoded != nil {
+		t.Fatalf("decoded %v bytes after the budget was used up", len(decoded))
+	}
+	// uncompressed streams are slices of the file and don't use the budget
+	if decoded := decodePdfStream("<< /Length 5 >>", []byte("BT ET\n"), &budget); string(decoded) != "BT ET" {
+		t.Fatalf("unexpected stream: %q", decoded)
+	}
+}
+
+func TestReadPdfLiteralString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		end  int
+	}{
+		{`(Faktura) Tj`, "Faktura", 9},
+		{`(a (nested) string)`, "a (nested) string", 19},
+		{`(escaped \) paren)`, "escaped ) paren", 18},
+		{`(line\nbreak)`, "line\nbreak", 13},
+		{`(\101\102C)`, "ABC", 11},
+		{"(con\\\ntinued)", "continued", 13},
+		{`(unterminated`, "unterminated", 13},
+	}
+	for _, tt := range tests {
+		got, end := readPdfLiteralString([]byte(tt.in), 0)
+		if string(got) != tt.want || end != tt.end {
+			t.Errorf("readPdfLiteralString(%q) = %q, %v, want %q, %v", tt.in, got, end, tt.want, tt.end)
+		}
+	}
+}
+
+func TestDecodeUTF16Hex(t *testing.T) {
+	tests := map[string]string{
+		"0041":      "A",
+		"0066 0069": "fi",
+		"D83DDCC4":  "📄",
+		"41":        "A",
+		"00ZZ":      "",
+	}
+	for in, want := range tests {
+		if got := decodeUTF16Hex(in); got != want {
+			t.Errorf("decodeUTF16Hex(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// FuzzExtractPdfText checks that no input makes the extractor panic or run for long
+func FuzzExtractPdfText(f *testing.F) {
+	f.Add(readTestdata(f, "invoice_simple.pdf"))
+	f.Add(readTestdata(f, "invoice_cid.pdf"))
+	f.Add(testPdf("BT /F1 12 Tf <0102> Tj ET", "1 beginbfrange <01> <FF> <0041> endbfrange"))
+	f.Add(testPdf("BT /F1 12 Tf [(A) -300 (B)] TJ ET", "1 beginbfchar <41> <0042> endbfchar"))
+	f.Add([]byte("%PDF-1.5\n1 0 obj\n<< /Type /ObjStm /N 2 /First 12 >>\nstream\n5 0 6 -100 << /Type /Page >>\nendstream\nendobj\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// panics are recovered in production, here they are parser bugs to fix
+			if _, err := extractPdfText(data); err != nil && strings.HasPrefix(err.Error(), "malformed PDF") {
+				t.Errorf("extractPdfText panicked: %v", err)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("extractPdfText didn't finish within 5s for a %v byte input", len(data))
+		}
+	})
+}
+
+func TestExtractPdfTextWithNegativeObjectStreamOffset(t *testing.T) {
+	// the header of the object stream points before its first object
+	objStm := "5 -100 << /Type /Page >>"
+	pdf := fmt.Sprintf("%%PDF-1.5\n1 0 obj\n<< /Type /ObjStm /N 1 /First 7 /Length %v >>\nstream\n%v\nendstream\nendobj\n", len(objStm), objStm)
+	if _, err := extractPdfText([]byte(pdf)); err == nil {
+		t.Fatal("expected an error for a PDF without pages")
+	}
+	objects := parsePdfObjects([]byte(pdf))
+	if _, ok := objects[5]; ok {
+		t.Fatalf("an object with a negative offset was read: %+v", objects[5])
+	}
+}
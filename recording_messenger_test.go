@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+type RecordedMessage struct {
+	OutgoingMessage
+	MessageID int
+}
+
+type RecordedEdit struct {
+	OutgoingMessage
+	MessageID int
+}
+
+type RecordedDocuments struct {
+	ChatID           int64
+	ReplyToMessageID int
+	Documents        []OutgoingDocument
+}
+
+type RecordedDeletion struct {
+	ChatID    int64
+	MessageID int
+}
+
+type RecordedCallbackAnswer struct {
+	CallbackID string
+	Text       string
+}
+
+// RecordingMessenger is an in-memory Messenger which records everything the bot
+// sends, so that the handlers can be exercised without talking to Telegram.
+type RecordingMessenger struct {
+	mu            sync.Mutex
+	nextMessageID int
+
+	Messages        []RecordedMessage
+	Edits           []RecordedEdit
+	Documents       []RecordedDocuments
+	Deletions       []RecordedDeletion
+	CallbackAnswers []RecordedCallbackAnswer
+	// Files are served by DownloadFile, keyed by the Telegram file ID
+	Files map[string][]byte
+}
+
+func NewRecordingMessenger() *RecordingMessenger {
+	return &RecordingMessenger{
+		nextMessageID: 1,
+		Files:         map[string][]byte{},
+	}
+}
+
+func (r *RecordingMessenger) SendText(msg OutgoingMessage) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.nextMessageID
+	r.nextMessageID++
+	r.Messages = append(r.Messages, RecordedMessage{OutgoingMessage: msg, MessageID: id})
+	return id, nil
+}
+
+func (r *RecordingMessenger) EditText(messageID int, msg OutgoingMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Edits = append(r.Edits, RecordedEdit{OutgoingMessage: msg, MessageID: messageID})
+	return nil
+}
+
+func (r *RecordingMessenger) SendDocuments(chatID int64, replyToMessageID int, docs []OutgoingDocument) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// files on disk are usually temporary, keep a copy of what was sent
+	recorded := []OutgoingDocument{}
+	for _, doc := range docs {
+		if doc.Path != "" {
+			contents, err := ioutil.ReadFile(doc.Path)
+			if err != nil {
+				return err
+			}
+			doc.Contents = contents
+			doc.Path = ""
+		}
+		recorded = append(recorded, doc)
+	}
+	r.Documents = append(r.Documents, RecordedDocuments{
+		ChatID:           chatID,
+		ReplyToMessageID: replyToMessageID,
+		Documents:        recorded,
+	})
+	return nil
+}
+
+func (r *RecordingMessenger) DeleteMessage(chatID int64, messageID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Deletions = append(r.Deletions, RecordedDeletion{ChatID: chatID, MessageID: messageID})
+	return nil
+}
+
+func (r *RecordingMessenger) AnswerCallback(callbackID string, text string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.CallbackAnswers = append(r.CallbackAnswers, RecordedCallbackAnswer{CallbackID: callbackID, Text: text})
+	return nil
+}
+
+func (r *RecordingMessenger) DownloadFile(fileID string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	contents, ok := r.Files[fileID]
+	if !ok {
+		return nil, fmt.Errorf("unknown file %v", fileID)
+	}
+	return contents, nil
+}
+
+// MessagesTo returns the text messages sent to the given chat, in order
+func (r *RecordingMessenger) MessagesTo(chatID int64) []RecordedMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := []RecordedMessage{}
+	for _, msg := range r.Messages {
+		if msg.ChatID == chatID {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// Reset forgets everything recorded so far
+func (r *RecordingMessenger) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Messages = nil
+	r.Edits = nil
+	r.Documents = nil
+	r.Deletions = nil
+	r.CallbackAnswers = nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "fmt"
+
+// roles from the least to the most privileged, each role can do everything the previous ones can
+const (
+	RoleViewer   = "viewer"
+	RoleUploader = "uploader"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleUploader: 2,
+	RoleAdmin:    3,
+}
+
+// commandRoles is the minimum role required to use a command,
+// uploading documents requires RoleUploader
+var commandRoles = map[string]string{
+	"invoices":      RoleViewer,
+	"download":      RoleViewer,
+	"search":        RoleViewer,
+	"sendzip":       RoleUploader,
+	"setmonth":      RoleUploader,
+	"invoice":       RoleUploader,
+	"duplicate":     RoleUploader,
+	"checkemail":    RoleUploader,
+	"notifications": RoleAdmin,
+	"apitoken":      RoleAdmin,
+	"users":         RoleAdmin,
+	"authorized":    RoleAdmin,
+	"setrole":       RoleAdmin,
+	"invite":        RoleAdmin,
+	"audit":         RoleAdmin,
+}
+
+func parseRole(s string) (string, error) {
+	if _, ok := roleLevels[s]; !ok {
+		return "", fmt.Errorf("invalid role: %v (expected viewer, uploader or admin)", s)
+	}
+	return s, nil
+}
+
+func (u *AuthorizedUser) HasRole(role string) bool {
+	return roleLevels[u.Role] >= roleLevels[role]
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// addTestUser authorizes another user with the given role
+func addTestUser(t *testing.T, id int64, userName, role string) *tgbotapi.User {
+	t.Helper()
+	if err := db.Create(&AuthorizedUser{TelegramID: id, UserName: userName, Role: role}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &tgbotapi.User{ID: id, UserName: userName}
+}
+
+func TestViewerCannotChangeInvoices(t *testing.T) {
+	recorder := setupTestBot(t)
+	viewer := addTestUser(t, 43, "viewer", RoleViewer)
+	uploadDocument(recorder, "invoice.pdf", readTestdata(t, "invoice_simple.pdf"))
+	recorder.Reset()
+
+	uploadDocumentAs(recorder, viewer, "other.pdf", []byte("%PDF-1.4 other"))
+	if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, "uploading invoices requires the uploader role, you are viewer") {
+		t.Errorf("expected the upload to be refused, got %q", msg.Text)
+	}
+	var count int64
+	db.Model(&Invoice{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected only the admin's invoice, got %v invoices", count)
+	}
+
+	for _, command := range []string{"/invoice 1", "/notifications", "/sendzip 2023-03"} {
+		recorder.Reset()
+		sendCommandAs(viewer, command)
+		name := strings.Fields(command)[0]
+		if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, name+" requires the") || !strings.Contains(msg.Text, "you are viewer") {
+			t.Errorf("expected %v to be refused, got %q", name, msg.Text)
+		}
+	}
+}
+
+func TestOnlyAdminsSeeAudit(t *testing.T) {
+	recorder := setupTestBot(t)
+	viewer := addTestUser(t, 43, "viewer", RoleViewer)
+	uploader := addTestUser(t, 44, "uploader", RoleUploader)
+	recordAuditEvent("telegram @tester (42)", AuditInvoiceUploaded, 1, "invoice.pdf")
+
+	for _, user := range []*tgbotapi.User{viewer, uploader} {
+		recorder.Reset()
+		sendCommandAs(user, "/audit")
+		if msg := lastMessage(t, recorder, testChatID); !strings.Contains(msg.Text, "/audit requires the admin role") {
+			t.Errorf("expected /audit to be refused for @%v, got %q", user.UserName, msg.Text)
+		}
+	}
+
+	recorder.Reset()
+	sendCommand("/audit")
+	if msg := lastMessage(t, recorder, testChatID); !strings.HasPrefix(msg.Text, "Recent events:") {
+		t.Errorf("expected the admin to see the audit log, got %q", msg.Text)
+	}
+}
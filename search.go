@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// maximum number of invoices returned by /search
+const searchResultsLimit = 20
+
+// InvoiceSearchText holds everything /search looks at for an invoice. The
+// invoice_search_fts FTS5 table indexes it, kept in sync by triggers. It uses
+// the trigram tokenizer, so that parts of words and numbers like a NIP
+// written as PL1234567890 can be found too.
+type InvoiceSearchText struct {
+	InvoiceID uint `gorm:"primaryKey;autoIncrement:false"`
+	FileName  string
+	Subject   string
+	Sender    string
+	Text      string
+}
+
+// set when the SQLite build supports FTS5, otherwise /search falls back to LIKE
+var invoiceSearchFts bool
+
+var searchPeriodRegex = regexp.MustCompile(`^\d{4}(-\d{2})?$`)
+
+// migrateInvoiceSearch creates the FTS5 index and indexes invoices stored before search existed
+func migrateInvoiceSearch() error {
+	if err := db.AutoMigrate(&InvoiceSearchText{}); err != nil {
+		return err
+	}
+	if err := backfillInvoiceSearchTexts(); err != nil {
+		return err
+	}
+	var existing int64
+	if err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE name = 'invoice_search_fts'").Scan(&existing).Error; err != nil {
+		return err
+	}
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS invoice_search_fts USING fts5(file_name, subject, sender, text, content='invoice_search_texts', content_rowid='invoice_id', tokenize='trigram')").Error
+	if err != nil {
+		log.Printf("full-text search is not available, falling back to substring search: %v", err)
+		return nil
+	}
+	invoiceSearchFts = true
+	triggers := []string{
+		`CREATE TRIGGER IF NOT EXISTS invoice_search_texts_ai AFTER INSERT ON invoice_search_texts BEGIN
+			INSERT INTO invoice_search_fts(rowid, file_name, subject, sender, text) VALUES (new.invoice_id, new.file_name, new.subject, new.sender, new.text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS invoice_search_texts_ad AFTER DELETE ON invoice_search_texts BEGIN
+			INSERT INTO invoice_search_fts(invoice_search_fts, rowid, file_name, subject, sender, text) VALUES ('delete', old.invoice_id, old.file_name, old.subject, old.sender, old.text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS invoice_search_texts_au AFTER UPDATE ON invoice_search_texts BEGIN
+			INSERT INTO invoice_search_fts(invoice_search_fts, rowid, file_name, subject, sender, text) VALUES ('delete', old.invoice_id, old.file_name, old.subject, old.sender, old.text);
+			INSERT INTO invoice_search_fts(rowid, file_name, subject, sender, text) VALUES (new.invoice_id, new.file_name, new.subject, new.sender, new.text);
+		END`,
+	}
+	for _, trigger := range triggers {
+		if err := db.Exec(trigger).Error; err != nil {
+			return err
+		}
+	}
+	if existing == 0 {
+		// index the rows written before the table existed
+		return db.Exec("INSERT INTO invoice_search_fts(invoice_search_fts) VALUES ('rebuild')").Error
+	}
+	return nil
+}
+
+// backfillInvoiceSearchTexts extracts the text of invoices which aren't indexed yet
+func backfillInvoiceSearchTexts() error {
+	var invoices []Invoice
+	err := db.Unscoped().Where("id NOT IN (SELECT invoice_id FROM invoice_search_texts)").Find(&invoices).Error
+	if err != nil {
+		return err
+	}
+	if len(invoices) > 0 {
+		log.Printf("indexing %v invoices for search", len(invoices))
+	}
+	for _, invoice := range invoices {
+		text := ""
+		if contents, err := readBlob(invoice.Sha256); err != nil {
+			log.Printf("error reading invoice #%v for indexing: %v", invoice.ID, err)
+		} else {
+			text, _ = readInvoiceContents(invoice.FileName, contents)
+		}
+		if err := db.Create(&InvoiceSearchText{InvoiceID: invoice.ID, FileName: invoice.FileName, Text: text}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexInvoice stores or updates the searchable texts of an invoice
+func indexInvoice(searchText *InvoiceSearchText) error {
+	return db.Save(&searchText).Error
+}
+
+// searchInvoices finds invoices matching all the words of the query in their
+// file name, e-mail subject, sender or text. Words like 2023 or 2023-10 limit
+// the results to a billing year or month instead.
+func searchInvoices(query string) ([]Invoice, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("empty search query")
+	}
+	terms := []string{}
+	tx := db.Model(&Invoice{}).Preload("Source").Limit(searchResultsLimit)
+	for _, word := range strings.Fields(query) {
+		if searchPeriodRegex.MatchString(word) {
+			year, month := 0, 0
+			fmt.Sscanf(word, "%d-%d", &year, &month)
+			tx = tx.Where("invoices.billing_year = ?", year)
+			if month != 0 {
+				tx = tx.Where("invoices.billing_month = ?", month)
+			}
+			continue
+		}
+		terms = append(terms, word)
+	}
+	// the trigram index can't look up words shorter than 3 characters
+	useFts := invoiceSearchFts && len(terms) > 0
+	for _, term := range terms {
+		if len([]rune(term)) < 3 {
+			useFts = false
+		}
+	}
+	if useFts {
+		// every word is quoted so that FTS5 syntax in the query can't cause errors
+		match := []string{}
+		for _, term := range terms {
+			match = append(match, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+		}
+		tx = tx.Joins("JOIN invoice_search_fts ON invoice_search_fts.rowid = invoices.id").
+			Where("invoice_search_fts MATCH ?", strings.Join(match, " ")).
+			Order("invoice_search_fts.rank")
+	} else {
+		tx = tx.Joins("JOIN invoice_search_texts ON invoice_search_texts.invoice_id = invoices.id")
+		for _, term := range terms {
+			like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+			tx = tx.Where(`(invoice_search_texts.file_name LIKE ? ESCAPE '\' OR invoice_search_texts.subject LIKE ? ESCAPE '\' OR invoice_search_texts.sender LIKE ? ESCAPE '\' OR invoice_search_texts.text LIKE ? ESCAPE '\')`, like, like, like, like)
+		}
+	}
+	var invoices []Invoice
+	if err := tx.Order("invoices.billing_year DESC, invoices.billing_month DESC, invoices.id DESC").Find(&invoices).Error; err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
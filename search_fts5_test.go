@@ -0,0 +1,57 @@
+//go:build sqlite_fts5
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// run with go test -tags sqlite_fts5 to use the FTS5 index of SQLite
+func TestSearchInvoicesWithFts5(t *testing.T) {
+	setupTestBot(t)
+	if !invoiceSearchFts {
+		t.Fatal("expected FTS5 to be available with the sqlite_fts5 build tag")
+	}
+	storeKsefTestInvoice(t, "march.xml", "FV/1", "2023-03-31", "Hosting", "billing@acme.example")
+	storeKsefTestInvoice(t, "april.xml", "FV/2", "2023-04-30", "Catering serwis", "kuchnia@food.example")
+	storeKsefTestInvoice(t, "old.xml", "FV/3", "2022-03-15", "Hosting", "billing@acme.example")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"hosting", "march.xml old.xml"},
+		// the trigram tokenizer finds parts of words
+		{"osting 2023", "march.xml"},
+		{"2023-04", "april.xml"},
+		{"kuchnia@food", "april.xml"},
+		{"catering serwis", "april.xml"},
+		{"hosting serwis", ""},
+		// FTS5 syntax is quoted away instead of causing errors
+		{`"hosting`, ""},
+		{"hosting OR catering", ""},
+		// words shorter than 3 characters fall back to substring search
+		{"FV/2 ca", "april.xml"},
+	}
+	for _, tt := range tests {
+		// the results are ordered by rank
+		names := searchFileNames(t, tt.query)
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("search %q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// the triggers keep the index in sync with renames
+	pressButton("/invoice 2 rename")
+	sendText(testUser(), testChatID, "obiad.xml")
+	pressButton("/invoice 2 rename confirm")
+	if got := strings.Join(searchFileNames(t, "obiad"), " "); got != "obiad.xml" {
+		t.Errorf("expected the renamed invoice to be found, got %q", got)
+	}
+	if got := searchFileNames(t, "april"); len(got) != 0 {
+		t.Errorf("expected the old name not to be found, got %v", got)
+	}
+}
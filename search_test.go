@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// storeKsefTestInvoice stores a copy of the KSeF fixture with another number, issue date and item
+func storeKsefTestInvoice(t *testing.T, fileName, number, issueDate, item, sender string) *Invoice {
+	t.Helper()
+	contents := strings.NewReplacer(
+		"FV/2023/03/17", number,
+		"<P_1>2023-03-31</P_1>", "<P_1>"+issueDate+"</P_1>",
+		"Hosting", item,
+	).Replace(string(readTestdata(t, "invoice_ksef.xml")))
+	invoice, err := processIncomingInvoice(fileName, []byte(contents), &InvoiceSource{Channel: SourceEmail, Sender: sender, Subject: "Invoice " + number})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoice
+}
+
+func searchFileNames(t *testing.T, query string) []string {
+	t.Helper()
+	invoices, err := searchInvoices(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, invoice := range invoices {
+		names = append(names, invoice.FileName)
+	}
+	return names
+}
+
+func useSubstringSearch(t *testing.T) {
+	previous := invoiceSearchFts
+	invoiceSearchFts = false
+	t.Cleanup(func() { invoiceSearchFts = previous })
+}
+
+func TestSearchInvoicesWithSubstringSearch(t *testing.T) {
+	setupTestBot(t)
+	useSubstringSearch(t)
+	storeKsefTestInvoice(t, "march.xml", "FV/1", "2023-03-31", "Hosting", "billing@acme.example")
+	storeKsefTestInvoice(t, "april.xml", "FV/2", "2023-04-30", "Catering serwis", "kuchnia@food.example")
+	storeKsefTestInvoice(t, "old.xml", "FV/3", "2022-03-15", "Hosting", "billing@acme.example")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// newest billing month first
+		{"hosting", "march.xml old.xml"},
+		{"HOSTING 2023", "march.xml"},
+		{"2023-04", "april.xml"},
+		{"2022", "old.xml"},
+		{"kuchnia@food", "april.xml"},
+		{"FV/2", "april.xml"},
+		{"hosting serwis", ""},
+		{"catering serwis", "april.xml"},
+		// LIKE wildcards in the query are matched literally
+		{"1%0", ""},
+		{"_", ""},
+		{"hosting 2023-05", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(searchFileNames(t, tt.query), " "); got != tt.want {
+			t.Errorf("search %q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if _, err := searchInvoices("  "); err == nil {
+		t.Error("expected an error for an empty query")
+	}
+}
+
+func TestSearchCommand(t *testing.T) {
+	recorder := setupTestBot(t)
+	storeKsefTestInvoice(t, "march.xml", "FV/1", "2023-03-31", "Hosting", "billing@acme.example")
+
+	sendCommand("/search hosting")
+	msg := lastMessage(t, recorder, testChatID)
+	if !strings.HasPrefix(msg.Text, "Found invoices:\n#1 2023-03: march.xml (1338.54 PLN)") || !hasButton(msg, "/download 1") {
+		t.Errorf("unexpected search results: %q %+v", msg.Text, msg.Buttons)
+	}
+	sendCommand("/search nothing-like-this")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "No invoices found" {
+		t.Errorf("unexpected reply: %q", msg.Text)
+	}
+}
+
+func TestSearchAfterRenameAndReindex(t *testing.T) {
+	setupTestBot(t)
+	useSubstringSearch(t)
+	storeKsefTestInvoice(t, "march.xml", "FV/1", "2023-03-31", "Hosting", "billing@acme.example")
+
+	pressButton("/invoice 1 rename")
+	sendText(testUser(), testChatID, "serwer.xml")
+	pressButton("/invoice 1 rename confirm")
+	if got := searchFileNames(t, "serwer"); len(got) != 1 {
+		t.Errorf("expected the new name to be found, got %v", got)
+	}
+	if got := searchFileNames(t, "march"); len(got) != 0 {
+		t.Errorf("expected the old name not to be found, got %v", got)
+	}
+
+	// invoices stored before search existed are indexed on the next start
+	if err := db.Exec("DELETE FROM invoice_search_texts").Error; err != nil {
+		t.Fatal(err)
+	}
+	if got := searchFileNames(t, "hosting"); len(got) != 0 {
+		t.Fatalf("expected nothing before reindexing, got %v", got)
+	}
+	if err := migrateInvoiceSearch(); err != nil {
+		t.Fatal(err)
+	}
+	useSubstringSearch(t)
+	if got := searchFileNames(t, "hosting"); len(got) != 1 || got[0] != "serwer.xml" {
+		t.Errorf("expected the reindexed invoice to be found, got %v", got)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type TelegramMessenger struct {
+	bot *tgbotapi.BotAPI
+}
+
+func NewTelegramMessenger(bot *tgbotapi.BotAPI) *TelegramMessenger {
+	return &TelegramMessenger{bot: bot}
+}
+
+func (t *TelegramMessenger) SendText(msg OutgoingMessage) (int, error) {
+	tgMsg := tgbotapi.NewMessage(msg.ChatID, msg.Text)
+	tgMsg.ParseMode = msg.ParseMode
+	tgMsg.ReplyToMessageID = msg.ReplyToMessageID
+	if len(msg.Buttons) > 0 {
+		tgMsg.ReplyMarkup = inlineKeyboard(msg.Buttons)
+	}
+	sent, err := t.bot.Send(tgMsg)
+	if err != nil {
+		return 0, err
+	}
+	return sent.MessageID, nil
+}
+
+func (t *TelegramMessenger) EditText(messageID int, msg OutgoingMessage) error {
+	edit := tgbotapi.NewEditMessageText(msg.ChatID, messageID, msg.Text)
+	edit.ParseMode = msg.ParseMode
+	if len(msg.Buttons) > 0 {
+		keyboard := inlineKeyboard(msg.Buttons)
+		edit.ReplyMarkup = &keyboard
+	}
+	_, err := t.bot.Request(edit)
+	return err
+}
+
+func inlineKeyboard(rows [][]MessageButton) tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup()
+	for _, row := range rows {
+		buttons := []tgbotapi.InlineKeyboardButton{}
+		for _, button := range row {
+			buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(button.Text, button.Data))
+		}
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, buttons)
+	}
+	return keyboard
+}
+
+func (t *TelegramMessenger) SendDocuments(chatID int64, replyToMessageID int, docs []OutgoingDocument) error {
+	media := []any{}
+	for _, doc := range docs {
+		var file tgbotapi.RequestFileData = tgbotapi.FileBytes{
+			Name:  doc.FileName,
+			Bytes: doc.Contents,
+		}
+		if doc.Path != "" {
+			f, err := os.Open(doc.Path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			file = tgbotapi.FileReader{
+				Name:   doc.FileName,
+				Reader: f,
+			}
+		}
+		if len(docs) == 1 {
+			// a single file is sent as a plain document, media groups are meant for 2-10 files
+			msg := tgbotapi.NewDocument(chatID, file)
+			msg.ReplyToMessageID = replyToMessageID
+			_, err := t.bot.Send(msg)
+			return err
+		}
+		media = append(media, tgbotapi.NewInputMediaDocument(file))
+	}
+	mg := tgbotapi.NewMediaGroup(chatID, media)
+	mg.ReplyToMessageID = replyToMessageID
+	_, err := t.bot.SendMediaGroup(mg)
+	return err
+}
+
+func (t *TelegramMessenger) DeleteMessage(chatID int64, messageID int) error {
+	_, err := t.bot.Request(tgbotapi.NewDeleteMessage(chatID, messageID))
+	return err
+}
+
+func (t *TelegramMessenger) AnswerCallback(callbackID string, text string) error {
+	_, err := t.bot.Request(tgbotapi.NewCallback(callbackID, text))
+	return err
+}
+
+func (t *TelegramMessenger) DownloadFile(fileID string) ([]byte, error) {
+	url, err := t.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading file %v: %v", fileID, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrLastAdmin = errors.New("the bot needs at least one admin")
+
+func (u *AuthorizedUser) DisplayName() string {
+	if u.UserName != "" {
+		return "@" + u.UserName
+	}
+	return strconv.FormatInt(u.TelegramID, 10)
+}
+
+func findAuthorizedUser(tx *gorm.DB, telegramID int64) (*AuthorizedUser, error) {
+	user := &AuthorizedUser{}
+	if err := tx.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("user %v is not authorized", telegramID)
+	}
+	return user, nil
+}
+
+// checkNotLastAdmin fails when user is the only admin left
+func checkNotLastAdmin(tx *gorm.DB, user *AuthorizedUser) error {
+	if user.Role != RoleAdmin {
+		return nil
+	}
+	var admins int64
+	if err := tx.Model(&AuthorizedUser{}).Where("role = ?", RoleAdmin).Count(&admins).Error; err != nil {
+		return err
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+func setUserRole(telegramID int64, role string) (*AuthorizedUser, error) {
+	var user *AuthorizedUser
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findAuthorizedUser(tx, telegramID); err != nil {
+			return err
+		}
+		if role != RoleAdmin {
+			if err := checkNotLastAdmin(tx, user); err != nil {
+				return err
+			}
+		}
+		user.Role = role
+		return tx.Save(&user).Error
+	})
+	return user, err
+}
+
+// revokeUser removes the user for good, so that they can be invited again later
+func revokeUser(telegramID int64) (*AuthorizedUser, error) {
+	var user *AuthorizedUser
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findAuthorizedUser(tx, telegramID); err != nil {
+			return err
+		}
+		if err := checkNotLastAdmin(tx, user); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+	return user, err
+}
+
+// dedupeAuthorizedUsers removes the rows created by running /authorize more than once,
+// keeping the oldest one, before the unique index on telegram_id is created
+func dedupeAuthorizedUsers() error {
+	if !db.Migrator().HasTable(&AuthorizedUser{}) {
+		return nil
+	}
+	if err := db.Exec("DELETE FROM authorized_users WHERE deleted_at IS NOT NULL").Error; err != nil {
+		return err
+	}
+	return db.Exec("DELETE FROM authorized_users WHERE id NOT IN (SELECT MIN(id) FROM authorized_users GROUP BY telegram_id)").Error
+}
+
+// handleUsersCommand implements /users:
+//
+//	/users                         lists the users
+//	/users <id>                    shows the actions for a user
+//	/users <id> role <role>        changes the role of a user
+//	/users <id> revoke [confirm]   revokes access of a user
+func handleUsersCommand(chatID int64, messageID int, args string, actor *AuthorizedUser) {
+	parts := strings.Fields(args)
+	if len(parts) == 0 {
+		var users []AuthorizedUser
+		if err := db.Order("id").Find(&users).Error; err != nil {
+			sendError(chatID, err)
+			return
+		}
+		usersStr := ""
+		buttons := [][]MessageButton{}
+		for _, user := range users {
+			usersStr += fmt.Sprintf("%v (%v): %v", user.DisplayName(), user.TelegramID, user.Role)
+			if user.InvitedBy != 0 {
+				usersStr += fmt.Sprintf(", invited by %v", user.InvitedBy)
+			}
+			usersStr += "\n"
+			buttons = append(buttons, []MessageButton{
+				{Text: fmt.Sprintf("%v (%v)", user.DisplayName(), user.Role), Data: fmt.Sprintf("/users %v", user.TelegramID)},
+			})
+		}
+		messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             "Authorized users:\n" + usersStr + "\nChoose a user to change their role or revoke their access.",
+			ReplyToMessageID: messageID,
+			Buttons:          buttons,
+		})
+		return
+	}
+	telegramID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		sendError(chatID, fmt.Errorf("invalid telegram id: %v", parts[0]))
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		user, err := findAuthorizedUser(db, telegramID)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		roleButtons := []MessageButton{}
+		for _, role := range []string{RoleViewer, RoleUploader, RoleAdmin} {
+			text := role
+			if role == user.Role {
+				text = "✓ " + role
+			}
+			roleButtons = append(roleButtons, MessageButton{Text: text, Data: fmt.Sprintf("/users %v role %v", telegramID, role)})
+		}
+		messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             fmt.Sprintf("%v (%v) is %v.", user.DisplayName(), user.TelegramID, user.Role),
+			ReplyToMessageID: messageID,
+			Buttons: [][]MessageButton{
+				roleButtons,
+				{{Text: "❌ Revoke access", Data: fmt.Sprintf("/users %v revoke", telegramID)}},
+			},
+		})
+	case len(parts) == 3 && parts[1] == "role":
+		role, err := parseRole(parts[2])
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		user, err := setUserRole(telegramID, role)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		recordAuditEvent(actor.AuditActor(), AuditUserRoleChanged, 0, fmt.Sprintf("%v is now %v", user.AuditActor(), role))
+		replyText(chatID, messageID, fmt.Sprintf("%v is now %v", user.DisplayName(), role))
+	case len(parts) == 2 && parts[1] == "revoke":
+		user, err := findAuthorizedUser(db, telegramID)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		messenger.SendText(OutgoingMessage{
+			ChatID:           chatID,
+			Text:             fmt.Sprintf("Revoke access of %v?", user.DisplayName()),
+			ReplyToMessageID: messageID,
+			Buttons: [][]MessageButton{{
+				{Text: "❌ Revoke", Data: fmt.Sprintf("/users %v revoke confirm", telegramID)},
+				{Text: "Cancel", Data: fmt.Sprintf("/users %v", telegramID)},
+			}},
+		})
+	case len(parts) == 3 && parts[1] == "revoke" && parts[2] == "confirm":
+		user, err := revokeUser(telegramID)
+		if err != nil {
+			sendError(chatID, err)
+			return
+		}
+		recordAuditEvent(actor.AuditActor(), AuditUserRevoked, 0, user.AuditActor())
+		replyText(chatID, messageID, fmt.Sprintf("Access of %v revoked", user.DisplayName()))
+	default:
+		sendError(chatID, fmt.Errorf("usage: /users [<telegram id> [role <role> | revoke]]"))
+	}
+}
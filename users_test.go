@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLastAdminCannotBeDemotedOrRevoked(t *testing.T) {
+	recorder := setupTestBot(t)
+
+	if _, err := setUserRole(testUserID, RoleViewer); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected demoting the last admin to fail, got %v", err)
+	}
+	if _, err := revokeUser(testUserID); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected revoking the last admin to fail, got %v", err)
+	}
+	pressButton("/users 42 revoke confirm")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "Error: "+ErrLastAdmin.Error() {
+		t.Errorf("unexpected reply: %q", msg.Text)
+	}
+	user := &AuthorizedUser{}
+	if err := db.Where("telegram_id = ?", testUserID).First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleAdmin {
+		t.Errorf("expected the last admin to stay admin, got %v", user.Role)
+	}
+
+	// promoting the only admin to admin again is not a demotion
+	if _, err := setUserRole(testUserID, RoleAdmin); err != nil {
+		t.Errorf("expected setting admin on the last admin to work, got %v", err)
+	}
+}
+
+func TestAdminCanBeDemotedWhenAnotherExists(t *testing.T) {
+	setupTestBot(t)
+	addTestUser(t, 43, "second", RoleAdmin)
+
+	user, err := setUserRole(testUserID, RoleUploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleUploader {
+		t.Errorf("expected uploader, got %v", user.Role)
+	}
+	// now 43 is the last admin
+	if _, err := setUserRole(43, RoleViewer); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected demoting the remaining admin to fail, got %v", err)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	recorder := setupTestBot(t)
+	addTestUser(t, 43, "viewer", RoleViewer)
+
+	pressButton("/users 43 revoke confirm")
+	if msg := lastMessage(t, recorder, testChatID); msg.Text != "Access of @viewer revoked" {
+		t.Errorf("unexpected reply: %q", msg.Text)
+	}
+	var count int64
+	db.Unscoped().Model(&AuthorizedUser{}).Where("telegram_id = ?", 43).Count(&count)
+	if count != 0 {
+		t.Error("expected the user to be removed for good")
+	}
+	event := &AuditEvent{}
+	if err := db.Where("action = ?", AuditUserRevoked).First(&event).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(event.Details, "@viewer") {
+		t.Errorf("unexpected audit details: %q", event.Details)
+	}
+
+	// a revoked user can be invited again
+	invite, err := createInviteCode(RoleViewer, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redeemInviteCode(invite.Code, 43, "viewer"); err != nil {
+		t.Errorf("expected the revoked user to redeem a new invite, got %v", err)
+	}
+
+	if _, err := revokeUser(99); err == nil {
+		t.Error("expected revoking an unknown user to fail")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dashboardLayout = `{{define "layout"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GK invoices</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.num { text-align: right; }
+nav a { margin-right: 1em; }
+</style>
+</head>
+<body>
+<nav><a href="/">Months</a><a href="/zips">Generated ZIPs</a></nav>
+{{template "content" .}}
+</body>
+</html>{{end}}`
+
+var dashboardTemplates = map[string]*template.Template{
+	"months": newDashboardTemplate(`{{define "content"}}
+<h1>Invoices</h1>
+<table>
+<tr><th>Month</th><th>Invoices</th><th>Gross</th><th>ZIP</th></tr>
+{{range .Months}}<tr>
+<td><a href="/month/{{.Month}}">{{.Month}}</a></td>
+<td class="num">{{.Count}}</td>
+<td class="num">{{.Gross}}</td>
+<td><a href="/month/{{.Month}}/zip">download</a></td>
+</tr>{{end}}
+</table>
+<h2>Notified chats</h2>
+<table>
+<tr><th>Chat</th><th>Last acknowledged month</th><th>Last notification</th></tr>
+{{range .Chats}}<tr>
+<td>{{.TelegramChatID}}</td>
+<td>{{if .LastAcknowledgedYear}}{{printf "%04d-%02d" .LastAcknowledgedYear .LastAcknowledgedMonth}}{{else}}never{{end}}</td>
+<td>{{if .LastNotificationSentAt}}{{.LastNotificationSentAt.Format "2006-01-02 15:04"}}{{end}}</td>
+</tr>{{end}}
+</table>
+{{end}}`),
+	"month": newDashboardTemplate(`{{define "content"}}
+<h1>Invoices for {{.Month}}</h1>
+<p><a href="/month/{{.Month}}/zip">Download ZIP</a></p>
+<table>
+<tr><th>#</th><th>Uploaded</th><th>File</th><th>Source</th><th>Number</th><th>Seller NIP</th><th>Issue date</th><th>Gross</th></tr>
+{{range .Invoices}}<tr>
+<td>{{.ID}}</td>
+<td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td>
+<td><a href="/invoice/{{.ID}}">{{.FileName}}</a></td>
+<td>{{.Source.Describe}}{{if .Source}}{{with .Source.Subject}}<br><small>{{.}}</small>{{end}}{{end}}</td>
+<td>{{.InvoiceNumber}}</td>
+<td>{{.SellerNIP}}</td>
+<td>{{if .IssueDate}}{{.IssueDate.Format "2006-01-02"}}{{end}}</td>
+<td class="num">{{amount .GrossAmount .Currency}}</td>
+</tr>{{end}}
+</table>
+{{end}}`),
+	"zips": newDashboardTemplate(`{{define "content"}}
+<h1>Generated ZIPs</h1>
+<table>
+<tr><th>Generated</th><th>File</th><th>Month</th><th>SHA-256</th><th>Acknowledged</th></tr>
+{{range .Zips}}<tr>
+<td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td>
+<td>{{.FileName}}</td>
+<td>{{printf "%04d-%02d" .Year .Month}}</td>
+<td><code>{{.Sha256}}</code></td>
+<td>{{index $.Acknowledged .ID}}</td>
+</tr>{{end}}
+</table>
+{{end}}`),
+}
+
+func newDashboardTemplate(content string) *template.Template {
+	t := template.New("").Funcs(template.FuncMap{
+		"amount": func(v *int64, currency string) string {
+			if v == nil {
+				return ""
+			}
+			return formatAmount(*v, currency)
+		},
+	})
+	template.Must(t.Parse(dashboardLayout))
+	return template.Must(t.Parse(content))
+}
+
+type dashboardMonth struct {
+	Month string
+	Count int
+	Gross string
+}
+
+// isDashboardEnabled tells whether the dashboard is served, it needs the basic auth credentials
+func isDashboardEnabled() bool {
+	return config.HttpUsername != "" && config.HttpPassword != ""
+}
+
+func newWebMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	if isDashboardEnabled() {
+		mux.HandleFunc("/", requireBasicAuth(handleDashboardMonths))
+		mux.HandleFunc("/month/", requireBasicAuth(handleDashboardMonth))
+		mux.HandleFunc("/invoice/", requireBasicAuth(handleDashboardInvoice))
+		mux.HandleFunc("/zips", requireBasicAuth(handleDashboardZips))
+	}
+	// the API authenticates with its own tokens
+	registerApiHandlers(mux)
+	return mux
+}
+
+func runWebServer() {
+	if isDashboardEnabled() {
+		log.Printf("starting web dashboard and API on %v", config.HttpListenAddress)
+	} else {
+		log.Printf("http_username and http_password are not set, starting only the API on %v", config.HttpListenAddress)
+	}
+	server := &http.Server{
+		Addr:              config.HttpListenAddress,
+		Handler:           newWebMux(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("web dashboard failed: %v", err)
+	}
+}
+
+func requireBasicAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(config.HttpUsername)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.HttpPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gk-invoices-bot"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// webActor describes the dashboard user for the audit log
+func webActor(r *http.Request) string {
+	username, _, _ := r.BasicAuth()
+	return "web " + username
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates[name].ExecuteTemplate(w, "layout", data); err != nil {
+		log.Printf("error rendering %v: %v", name, err)
+	}
+}
+
+func handleDashboardMonths(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	rows, err := db.Raw("SELECT printf('%04d-%02d', billing_year, billing_month) as month, COUNT(*) as count, currency, SUM(gross_amount) FROM invoices WHERE deleted_at IS NULL GROUP BY month, currency ORDER BY month DESC, currency").Rows()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	months := []*dashboardMonth{}
+	for rows.Next() {
+		var month string
+		var count int
+		var currency *string
+		var gross *int64
+		if err := rows.Scan(&month, &count, &currency, &gross); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(months) == 0 || months[len(months)-1].Month != month {
+			months = append(months, &dashboardMonth{Month: month})
+		}
+		m := months[len(months)-1]
+		m.Count += count
+		if gross != nil {
+			if m.Gross != "" {
+				m.Gross += ", "
+			}
+			c := ""
+			if currency != nil {
+				c = *currency
+			}
+			m.Gross += formatAmount(*gross, c)
+		}
+	}
+	chats := []NotifiedChat{}
+	if err := db.Find(&chats).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderDashboard(w, "months", map[string]any{
+		"Months": months,
+		"Chats":  chats,
+	})
+}
+
+func handleDashboardMonth(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/month/"), "/"), "/")
+	year, month, err := parseYearMonth(parts[0])
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "zip") {
+		http.NotFound(w, r)
+		return
+	}
+	invoices, err := findMonthInvoices(year, month)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(parts) == 2 {
+		serveMonthZip(w, year, month, invoices, webActor(r))
+		return
+	}
+	renderDashboard(w, "month", map[string]any{
+		"Month":    parts[0],
+		"Invoices": invoices,
+	})
+}
+
+// serveMonthZip streams the ZIP of a billing month, recording it like the /invoices command does
+func serveMonthZip(w http.ResponseWriter, year int, month int, invoices []Invoice, actor string) {
+	if len(invoices) == 0 {
+		http.Error(w, "no invoices for this month", http.StatusNotFound)
+		return
+	}
+	zipPath, generated, err := generateMonthZip(year, month, invoices, actor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(zipPath)
+	f, err := os.Open(zipPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": generated.FileName}))
+	io.Copy(w, f)
+}
+
+func handleDashboardInvoice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/invoice/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	invoice := &Invoice{}
+	if err := db.First(&invoice, id).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	serveInvoiceFile(w, invoice, webActor(r))
+}
+
+func serveInvoiceFile(w http.ResponseWriter, invoice *Invoice, actor string) {
+	blob, err := openBlob(invoice.Sha256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+	contentType := mime.TypeByExtension(filepath.Ext(invoice.FileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": invoice.FileName}))
+	recordAuditEvent(actor, AuditInvoiceDownloaded, invoice.ID, invoice.FileName)
+	io.Copy(w, blob)
+}
+
+func handleDashboardZips(w http.ResponseWriter, r *http.Request) {
+	zips := []GeneratedZip{}
+	if err := db.Order("created_at DESC").Find(&zips).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chats := []NotifiedChat{}
+	if err := db.Find(&chats).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// a ZIP counts as acknowledged once every notified chat has acknowledged its month
+	acknowledged := map[uint]string{}
+	for _, zip := range zips {
+		count := 0
+		for _, chat := range chats {
+			if chat.LastAcknowledgedYear > zip.Year || (chat.LastAcknowledgedYear == zip.Year && chat.LastAcknowledgedMonth >= zip.Month) {
+				count++
+			}
+		}
+		acknowledged[zip.ID] = fmt.Sprintf("%v/%v chats", count, len(chats))
+	}
+	renderDashboard(w, "zips", map[string]any{
+		"Zips":         zips,
+		"Acknowledged": acknowledged,
+	})
+}
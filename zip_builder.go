@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+func monthZipFileName(month string) string {
+	return "GK_faktury_" + month + ".zip"
+}
+
+// generateMonthZip builds the ZIP of a billing month and remembers its hash, so that
+// the archive can be recognized when it is forwarded back to the bot by e-mail.
+// The caller is responsible for removing the returned file.
+func generateMonthZip(year int, month int, invoices []Invoice, actor string) (string, *GeneratedZip, error) {
+	monthStr := fmt.Sprintf("%04d-%02d", year, month)
+	zipPath, zipSha256, err := buildInvoicesZip(monthStr, invoices)
+	if err != nil {
+		return "", nil, err
+	}
+	generated := &GeneratedZip{
+		Sha256:   zipSha256,
+		FileName: monthZipFileName(monthStr),
+		Year:     year,
+		Month:    month,
+	}
+	if err := db.Where("sha256 = ?", zipSha256).FirstOrCreate(&generated).Error; err != nil {
+		os.Remove(zipPath)
+		return "", nil, err
+	}
+	recordAuditEvent(actor, AuditZipGenerated, 0, fmt.Sprintf("%v with %v invoices, sha256 %v", generated.FileName, len(invoices), zipSha256))
+	return zipPath, generated, nil
+}
+
+// buildInvoicesZip writes a ZIP with the given invoices to a temporary file,
+// reading the invoice contents straight from the blob store. The caller is
+// responsible for removing the returned file.
+func buildInvoicesZip(month string, invoices []Invoice) (zipPath string, sha string, err error) {
+	f, err := ioutil.TempFile("", "GK_faktury_"+month+"-*.zip")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	hash := sha256.New()
+	w := zip.NewWriter(io.MultiWriter(f, hash))
+	dir := "GK_faktury_" + month + "/"
+	usedNames := map[string]bool{"index.csv": true}
+	entryNames := []string{}
+	for _, invoice := range invoices {
+		name := uniqueZipEntryName(invoice.FileName, usedNames)
+		if err := writeInvoiceToZip(w, dir+name, invoice); err != nil {
+			return "", "", err
+		}
+		entryNames = append(entryNames, name)
+	}
+	if err := writeInvoicesIndex(w, dir+"index.csv", invoices, entryNames); err != nil {
+		return "", "", fmt.Errorf("error writing index: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return f.Name(), fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// uniqueZipEntryName makes sure two invoices with the same file name don't end up
+// as duplicate entries, e.g. the second faktura.pdf becomes faktura (2).pdf
+func uniqueZipEntryName(name string, used map[string]bool) string {
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%v (%v)%v", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
+// writeInvoicesIndex adds a CSV listing the invoices in the archive, so that
+// the package can be reconciled without opening every file
+func writeInvoicesIndex(w *zip.Writer, name string, invoices []Invoice, entryNames []string) error {
+	f, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	// the BOM makes spreadsheet software detect the file as UTF-8
+	if _, err := f.Write([]byte("\ufeff")); err != nil {
+		return err
+	}
+	csvWriter := csv.NewWriter(f)
+	csvWriter.Write([]string{
+		"file_name", "upload_date", "sender", "billing_month", "sha256", "invoice_number",
+		"seller_nip", "issue_date", "net_amount", "vat_amount", "gross_amount", "currency",
+		"source", "subject",
+	})
+	optionalAmount := func(v *int64) string {
+		if v == nil {
+			return ""
+		}
+		return formatAmount(*v, "")
+	}
+	for i, invoice := range invoices {
+		issueDate := ""
+		if invoice.IssueDate != nil {
+			issueDate = invoice.IssueDate.Format("2006-01-02")
+		}
+		source := invoice.Source
+		if source == nil {
+			source = &InvoiceSource{}
+		}
+		csvWriter.Write([]string{
+			entryNames[i],
+			invoice.CreatedAt.Format("2006-01-02 15:04:05"),
+			source.Sender,
+			invoice.BillingPeriod(),
+			invoice.Sha256,
+			invoice.InvoiceNumber,
+			invoice.SellerNIP,
+			issueDate,
+			optionalAmount(invoice.NetAmount),
+			optionalAmount(invoice.VatAmount),
+			optionalAmount(invoice.GrossAmount),
+			invoice.Currency,
+			source.Channel,
+			source.Subject,
+		})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func writeInvoiceToZip(w *zip.Writer, name string, invoice Invoice) error {
+	blob, err := openBlob(invoice.Sha256)
+	if err != nil {
+		return fmt.Errorf("error opening contents of %v: %v", invoice.FileName, err)
+	}
+	defer blob.Close()
+	f, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, blob)
+	return err
+}